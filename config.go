@@ -0,0 +1,191 @@
+package sqlite06
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the optional settings of a DB, the zero value is the default
+type Config struct {
+	// WAL switches the database to write-ahead logging, which lets readers
+	// and a writer work at the same time. The setting is persistent: once a
+	// database file is in WAL mode it stays there for every later connection.
+	WAL bool
+
+	// JournalMode sets the journal mode by name, one of DELETE, TRUNCATE,
+	// PERSIST, MEMORY, WAL or OFF. When it is set, WAL is ignored.
+	JournalMode string
+
+	// Synchronous sets how often SQLite waits for data to reach the disk,
+	// one of OFF, NORMAL, FULL or EXTRA. Empty keeps the SQLite default of FULL.
+	// NORMAL is safe in WAL mode and makes writes noticeably faster.
+	Synchronous string
+
+	// CacheSize is the page cache of each connection, a number of pages
+	// or, when negative, a size in KiB as with PRAGMA cache_size.
+	// Zero keeps the SQLite default of 2MB.
+	CacheSize int
+
+	// BusyTimeout is how long a connection waits for a lock held by another
+	// one before failing with SQLITE_BUSY. Zero keeps the driver default of 5 seconds.
+	// The transactions of the package take the write lock when they begin,
+	// so concurrent writers wait for each other instead of failing. This
+	// also holds for transactions started on DB(), which uses the same DSN.
+	BusyTimeout time.Duration
+
+	// DefaultTimeout bounds every call of a method without a context, such as
+	// ListUsers, from start to end. The Context variants use the deadline of
+	// the context they are given instead. Zero, the default, means no timeout.
+	DefaultTimeout time.Duration
+
+	// MaxRetries is how many more times a write is attempted when it still
+	// fails with SQLITE_BUSY or SQLITE_LOCKED after BusyTimeout, waiting
+	// RetryDelay before the first retry and twice as long before each
+	// following one. Zero, the default, disables retries. A RetryDelay of
+	// zero means 10ms. Writes of ImportCSV are never retried, because
+	// the input cannot be read a second time.
+	MaxRetries int
+	RetryDelay time.Duration
+
+	// MaxOpenConns and MaxIdleConns limit the connection pool, like the
+	// methods of sql.DB with the same names. Zero keeps the database/sql
+	// defaults of no limit and 2 idle connections. SQLite allows a single
+	// writer at a time, so MaxOpenConns = 1 avoids most SQLITE_BUSY errors,
+	// at the cost of also serializing the readers.
+	// In-memory databases always use a single connection.
+	MaxOpenConns int
+	MaxIdleConns int
+
+	// OpenTimeout is how long New keeps trying to open the database while it
+	// fails, for instance because it is still locked by a process that is
+	// shutting down, waiting RetryDelay and then twice as long after every
+	// attempt. New returns the error of the last attempt. Zero, the default,
+	// tries only once.
+	OpenTimeout time.Duration
+
+	// Reconnect opens the database again when an operation fails because the
+	// file cannot be used through the open connections any more, for instance
+	// after it was replaced or its disk was remounted, and runs the operation
+	// once more. Other operations running at that moment may fail.
+	// It has no effect on in-memory databases.
+	Reconnect bool
+
+	// CaseSensitiveUsernames keeps the case of usernames as it is given, so that
+	// "Alice" and "alice" are two different users. By default every
+	// username is lowercased before it is stored or looked up.
+	// It has to be set already when the database is created: otherwise
+	// Migrate adds a case-insensitive unique index on Username, and
+	// "Alice" is rejected with ErrUserExists once "alice" exists.
+	CaseSensitiveUsernames bool
+
+	// ReadOnly opens the database without write access, which also works on
+	// read-only file systems. Every write then fails with ErrReadOnly.
+	// The file has to exist already.
+	ReadOnly bool
+
+	// MaxDescriptionLength is the largest number of characters a Description
+	// can have, zero means no limit. A longer one fails with ErrInvalidDescription,
+	// or is cut to the limit if TruncateDescription is set. Invalid UTF-8 is
+	// always removed from a Description before it is stored.
+	MaxDescriptionLength int
+	TruncateDescription  bool
+
+	// SkipExistsCheck makes AddUser, AddUsers and the imports insert a user
+	// without looking its username up first, saving a query per user.
+	// A taken username is then only detected by the unique indexes that
+	// Migrate creates, so the database has to be migrated: the errors stay
+	// the same, but a table without the indexes would accept duplicates.
+	SkipExistsCheck bool
+
+	// DryRun makes DeleteAllUsers, DeleteUsers and CleanupOrphans roll back
+	// their transaction instead of committing it. They still return the
+	// number of rows they would have deleted, but the database is left as it was.
+	DryRun bool
+
+	// UsersTable, UserdataTable and MetadataTable replace the default table
+	// names Users, Userdata and Metadata, so that the tables of this package
+	// can live next to others in the same database. Empty keeps the default.
+	// The names have to be plain identifiers: letters, digits and underscores.
+	UsersTable    string
+	UserdataTable string
+	MetadataTable string
+}
+
+// normalizeUsername returns the form of username that is stored and compared
+// Every function that takes a username has to pass it through here.
+// Surrounding whitespace is always removed, whitespace inside is kept.
+func (db *DB) normalizeUsername(username string) string {
+	username = strings.TrimSpace(username)
+	if db.config.CaseSensitiveUsernames {
+		return username
+	}
+	return strings.ToLower(username)
+}
+
+// isMemory reports whether filename names an in-memory database
+func isMemory(filename string) bool {
+	return filename == ":memory:" || strings.HasPrefix(filename, "file::memory:") ||
+		strings.Contains(filename, "mode=memory")
+}
+
+// dsn adds the connection parameters for config to filename
+// Every setting is a per connection pragma, so it goes in the DSN
+// and the driver applies it to every connection of the pool.
+// The driver rejects invalid values when the first connection is opened.
+func (config Config) dsn(filename string) string {
+	params := url.Values{}
+	// SQLite only enforces foreign keys when asked to. They are not optional:
+	// deleting a user relies on ON DELETE CASCADE to remove its Userdata row.
+	params.Set("_foreign_keys", "on")
+	switch {
+	case config.JournalMode != "":
+		params.Set("_journal_mode", config.JournalMode)
+	case config.WAL:
+		params.Set("_journal_mode", "WAL")
+	}
+	if config.Synchronous != "" {
+		params.Set("_synchronous", config.Synchronous)
+	}
+	if config.CacheSize != 0 {
+		params.Set("_cache_size", strconv.Itoa(config.CacheSize))
+	}
+	if config.BusyTimeout > 0 {
+		params.Set("_busy_timeout", strconv.FormatInt(config.BusyTimeout.Milliseconds(), 10))
+	}
+	// The transactions of this package read before they write. A deferred
+	// transaction that upgrades to a write lock fails with SQLITE_BUSY at once,
+	// without waiting for BusyTimeout, so they take the write lock when they begin.
+	// A read-only connection cannot take it.
+	if !config.ReadOnly {
+		params.Set("_txlock", "immediate")
+	}
+
+	// The driver only passes mode on to SQLite in a "file:" URI
+	if config.ReadOnly && !isMemory(filename) {
+		params.Set("mode", "ro")
+		if !strings.HasPrefix(filename, "file:") {
+			filename = "file:" + uriEscaper.Replace(filename)
+		}
+	}
+
+	separator := "?"
+	if strings.Contains(filename, "?") {
+		separator = "&"
+	}
+	return filename + separator + params.Encode()
+}
+
+// defaultContext returns the context of the methods that take none,
+// which ends after Config.DefaultTimeout if it is set
+func (db *DB) defaultContext() (context.Context, context.CancelFunc) {
+	if db.config.DefaultTimeout > 0 {
+		return context.WithTimeout(context.Background(), db.config.DefaultTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// uriEscaper escapes the characters of a path that have a meaning in a "file:" URI
+var uriEscaper = strings.NewReplacer(`%`, `%25`, `?`, `%3f`, `#`, `%23`)
@@ -0,0 +1,1242 @@
+package sqlite06
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// The package-level functions below are kept for backward compatibility.
+// They operate on the database whose path is stored in Filename.
+// New code should create its own handle with New and use the DB methods.
+//
+// Concurrency: a *DB and the package-level functions can be used from many
+// goroutines at once. The exceptions are Close and Rename, and changing Filename,
+// which closes the handle of the previous file: operations running at that
+// moment fail, typically with ErrClosed.
+// Assigning Filename directly is a data race with the package-level functions
+// running in other goroutines, use SetFilename once they have started.
+
+var (
+	// Before calling any of the package-level functions, programmer has to set
+	// `Filename` variable using: sqlite06.Filename = "ch06.db" for instance.
+	Filename = ""
+)
+
+// defaultMu guards Filename and defaultHandle
+var (
+	defaultMu     sync.RWMutex
+	defaultHandle *DB
+)
+
+// SetFilename sets Filename in a way that is safe while other goroutines
+// call the package-level functions
+func SetFilename(filename string) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	Filename = filename
+}
+
+// defaultDB returns the DB for the current value of Filename.
+// The handle is opened on first use and reopened whenever Filename changes.
+func defaultDB() (*DB, error) {
+	// Fast path for the common case of an open handle for Filename
+	defaultMu.RLock()
+	db := defaultHandle
+	if db != nil && db.filename == Filename {
+		defaultMu.RUnlock()
+		return db, nil
+	}
+	defaultMu.RUnlock()
+
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	// Another goroutine may have opened it in the meantime
+	if defaultHandle != nil && defaultHandle.filename == Filename {
+		return defaultHandle, nil
+	}
+	if defaultHandle != nil {
+		err := defaultHandle.Close()
+		if err != nil {
+			logf("closing %s: %v", defaultHandle.filename, err)
+		}
+		defaultHandle = nil
+	}
+
+	db, err := New(Filename)
+	if err != nil {
+		return nil, err
+	}
+	defaultHandle = db
+	return defaultHandle, nil
+}
+
+// DatabaseExists reports whether the database pointed to by Filename exists,
+// see DatabaseFileExists. Unlike the other functions it does not open it.
+func DatabaseExists() (bool, error) {
+	defaultMu.RLock()
+	filename := Filename
+	defaultMu.RUnlock()
+	return DatabaseFileExists(filename)
+}
+
+// Close releases the connections held for the database pointed to by Filename
+func Close() error {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	if defaultHandle == nil {
+		return nil
+	}
+	err := defaultHandle.Close()
+	defaultHandle = nil
+	return err
+}
+
+// InitDB creates the tables of the database pointed to by Filename
+func InitDB() error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.InitDB()
+}
+
+// InitDBContext is like InitDB but uses ctx for the database calls
+func InitDBContext(ctx context.Context) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.InitDBContext(ctx)
+}
+
+// UserExists checks for a user of the database pointed to by Filename
+func UserExists(username string) (bool, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return false, err
+	}
+	return db.UserExists(username)
+}
+
+// UserExistsContext is like UserExists but uses ctx for the database calls
+func UserExistsContext(ctx context.Context, username string) (bool, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return false, err
+	}
+	return db.UserExistsContext(ctx, username)
+}
+
+// AddUser adds a new user to the database pointed to by Filename
+func AddUser(d Userdata) (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return -1, err
+	}
+	return db.AddUser(d)
+}
+
+// AddUserContext is like AddUser but uses ctx for the database calls
+func AddUserContext(ctx context.Context, d Userdata) (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return -1, err
+	}
+	return db.AddUserContext(ctx, d)
+}
+
+// CreateUser adds a new user to the database pointed to by Filename
+// and returns it as it has been stored
+func CreateUser(d Userdata) (Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return Userdata{}, err
+	}
+	return db.CreateUser(d)
+}
+
+// CreateUserContext is like CreateUser but uses ctx for the database calls
+func CreateUserContext(ctx context.Context, d Userdata) (Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return Userdata{}, err
+	}
+	return db.CreateUserContext(ctx, d)
+}
+
+// AddUsers adds new users to the database pointed to by Filename
+func AddUsers(users []Userdata) ([]int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.AddUsers(users)
+}
+
+// AddUsersContext is like AddUsers but uses ctx for the database calls
+func AddUsersContext(ctx context.Context, users []Userdata) ([]int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.AddUsersContext(ctx, users)
+}
+
+// DeleteUser deletes a user from the database pointed to by Filename
+func DeleteUser(id int) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.DeleteUser(id)
+}
+
+// DeleteUserContext is like DeleteUser but uses ctx for the database calls
+func DeleteUserContext(ctx context.Context, id int) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.DeleteUserContext(ctx, id)
+}
+
+// DeleteUserByUsername deletes a user from the database pointed to by Filename
+func DeleteUserByUsername(username string) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.DeleteUserByUsername(username)
+}
+
+// DeleteUserByUsernameContext is like DeleteUserByUsername but uses ctx for the database calls
+func DeleteUserByUsernameContext(ctx context.Context, username string) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.DeleteUserByUsernameContext(ctx, username)
+}
+
+// ListUsers returns all users of the database pointed to by Filename
+func ListUsers() ([]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListUsers()
+}
+
+// ListUsersContext is like ListUsers but uses ctx for the database calls
+func ListUsersContext(ctx context.Context) ([]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListUsersContext(ctx)
+}
+
+// ListUsersPage returns a page of users of the database pointed to by Filename
+func ListUsersPage(limit, offset int) ([]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListUsersPage(limit, offset)
+}
+
+// ListUsersPageContext is like ListUsersPage but uses ctx for the database calls
+func ListUsersPageContext(ctx context.Context, limit, offset int) ([]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListUsersPageContext(ctx, limit, offset)
+}
+
+// ListUsersPaged returns a page of the users of the database pointed to by Filename
+// together with the total number of users
+func ListUsersPaged(limit, offset int) ([]Userdata, int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, 0, err
+	}
+	return db.ListUsersPaged(limit, offset)
+}
+
+// ListUsersPagedContext is like ListUsersPaged but uses ctx for the database calls
+func ListUsersPagedContext(ctx context.Context, limit, offset int) ([]Userdata, int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, 0, err
+	}
+	return db.ListUsersPagedContext(ctx, limit, offset)
+}
+
+// SearchUsers searches the users of the database pointed to by Filename
+func SearchUsers(query string) ([]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.SearchUsers(query)
+}
+
+// SearchUsersContext is like SearchUsers but uses ctx for the database calls
+func SearchUsersContext(ctx context.Context, query string) ([]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.SearchUsersContext(ctx, query)
+}
+
+// CountUsers returns the number of users of the database pointed to by Filename
+func CountUsers() (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.CountUsers()
+}
+
+// CountUsersContext is like CountUsers but uses ctx for the database calls
+func CountUsersContext(ctx context.Context) (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.CountUsersContext(ctx)
+}
+
+// GetUserByID returns a user of the database pointed to by Filename
+func GetUserByID(id int) (Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return Userdata{}, err
+	}
+	return db.GetUserByID(id)
+}
+
+// GetUserByIDContext is like GetUserByID but uses ctx for the database calls
+func GetUserByIDContext(ctx context.Context, id int) (Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return Userdata{}, err
+	}
+	return db.GetUserByIDContext(ctx, id)
+}
+
+// GetUserByUsername returns a user of the database pointed to by Filename
+func GetUserByUsername(username string) (Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return Userdata{}, err
+	}
+	return db.GetUserByUsername(username)
+}
+
+// GetUserByUsernameContext is like GetUserByUsername but uses ctx for the database calls
+func GetUserByUsernameContext(ctx context.Context, username string) (Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return Userdata{}, err
+	}
+	return db.GetUserByUsernameContext(ctx, username)
+}
+
+// UpdateUser updates a user of the database pointed to by Filename
+func UpdateUser(d Userdata) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.UpdateUser(d)
+}
+
+// UpdateUserContext is like UpdateUser but uses ctx for the database calls
+func UpdateUserContext(ctx context.Context, d Userdata) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.UpdateUserContext(ctx, d)
+}
+
+// UpdateUsername renames a user of the database pointed to by Filename
+func UpdateUsername(id int, newUsername string) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.UpdateUsername(id, newUsername)
+}
+
+// UpdateUsernameContext is like UpdateUsername but uses ctx for the database calls
+func UpdateUsernameContext(ctx context.Context, id int, newUsername string) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.UpdateUsernameContext(ctx, id, newUsername)
+}
+
+// UpdateUserFields partially updates a user of the database pointed to by Filename
+func UpdateUserFields(id int, fields map[string]any) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.UpdateUserFields(id, fields)
+}
+
+// UpdateUserFieldsContext is like UpdateUserFields but uses ctx for the database calls
+func UpdateUserFieldsContext(ctx context.Context, id int, fields map[string]any) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.UpdateUserFieldsContext(ctx, id, fields)
+}
+
+// GetUserByEmail returns a user of the database pointed to by Filename
+func GetUserByEmail(email string) (Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return Userdata{}, err
+	}
+	return db.GetUserByEmail(email)
+}
+
+// GetUserByEmailContext is like GetUserByEmail but uses ctx for the database calls
+func GetUserByEmailContext(ctx context.Context, email string) (Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return Userdata{}, err
+	}
+	return db.GetUserByEmailContext(ctx, email)
+}
+
+// Migrate upgrades the schema of the database pointed to by Filename
+func Migrate() error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.Migrate()
+}
+
+// MigrateContext is like Migrate but uses ctx for the database calls
+func MigrateContext(ctx context.Context) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.MigrateContext(ctx)
+}
+
+// Vacuum rebuilds the database file pointed to by Filename
+func Vacuum() error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.Vacuum()
+}
+
+// VacuumContext is like Vacuum but uses ctx for the database calls
+func VacuumContext(ctx context.Context) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.VacuumContext(ctx)
+}
+
+// Backup copies the database pointed to by Filename to destPath
+func Backup(destPath string, overwrite bool) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.Backup(destPath, overwrite)
+}
+
+// BackupContext is like Backup but uses ctx for the database calls
+func BackupContext(ctx context.Context, destPath string, overwrite bool) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.BackupContext(ctx, destPath, overwrite)
+}
+
+// ExportJSON writes the users of the database pointed to by Filename to w as JSON
+func ExportJSON(w io.Writer) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.ExportJSON(w)
+}
+
+// ExportJSONContext is like ExportJSON but uses ctx for the database calls
+func ExportJSONContext(ctx context.Context, w io.Writer) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.ExportJSONContext(ctx, w)
+}
+
+// ExportUserJSON writes a user of the database pointed to by Filename to w as JSON
+func ExportUserJSON(id int, w io.Writer) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.ExportUserJSON(id, w)
+}
+
+// ExportUserJSONContext is like ExportUserJSON but uses ctx for the database calls
+func ExportUserJSONContext(ctx context.Context, id int, w io.Writer) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.ExportUserJSONContext(ctx, id, w)
+}
+
+// ImportJSON adds the users read from r to the database pointed to by Filename
+func ImportJSON(r io.Reader) (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.ImportJSON(r)
+}
+
+// ImportJSONContext is like ImportJSON but uses ctx for the database calls
+func ImportJSONContext(ctx context.Context, r io.Reader) (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.ImportJSONContext(ctx, r)
+}
+
+// ExportCSV writes the users of the database pointed to by Filename to w as CSV
+func ExportCSV(w io.Writer) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.ExportCSV(w)
+}
+
+// ExportCSVContext is like ExportCSV but uses ctx for the database calls
+func ExportCSVContext(ctx context.Context, w io.Writer) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.ExportCSVContext(ctx, w)
+}
+
+// ImportCSV adds the users read from r to the database pointed to by Filename
+func ImportCSV(r io.Reader) (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.ImportCSV(r)
+}
+
+// ImportCSVContext is like ImportCSV but uses ctx for the database calls
+func ImportCSVContext(ctx context.Context, r io.Reader) (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.ImportCSVContext(ctx, r)
+}
+
+// ListUsersByUsernamePrefix returns the users of the database pointed to by Filename
+// whose username starts with prefix
+func ListUsersByUsernamePrefix(prefix string, limit int) ([]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListUsersByUsernamePrefix(prefix, limit)
+}
+
+// ListUsersByUsernamePrefixContext is like ListUsersByUsernamePrefix but uses ctx for the database calls
+func ListUsersByUsernamePrefixContext(ctx context.Context, prefix string, limit int) ([]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListUsersByUsernamePrefixContext(ctx, prefix, limit)
+}
+
+// ListUsersBySurname returns users of the database pointed to by Filename by surname
+func ListUsersBySurname(surname string) ([]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListUsersBySurname(surname)
+}
+
+// ListUsersBySurnameContext is like ListUsersBySurname but uses ctx for the database calls
+func ListUsersBySurnameContext(ctx context.Context, surname string) ([]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListUsersBySurnameContext(ctx, surname)
+}
+
+// WithTransaction runs fn inside a transaction on the database pointed to by Filename
+func WithTransaction(fn func(tx *Tx) error) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.WithTransaction(fn)
+}
+
+// WithTransactionContext is like WithTransaction but uses ctx for the database calls
+func WithTransactionContext(ctx context.Context, fn func(tx *Tx) error) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.WithTransactionContext(ctx, fn)
+}
+
+// GetStats returns the Stats of the database pointed to by Filename
+// It cannot be called Stats, since that is the name of the returned type
+func GetStats() (Stats, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return Stats{}, err
+	}
+	return db.Stats()
+}
+
+// GetStatsContext is like GetStats but uses ctx for the database calls
+func GetStatsContext(ctx context.Context) (Stats, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return Stats{}, err
+	}
+	return db.StatsContext(ctx)
+}
+
+// GetUsersByIDs returns users of the database pointed to by Filename by ID
+func GetUsersByIDs(ids []int) (map[int]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.GetUsersByIDs(ids)
+}
+
+// GetUsersByIDsContext is like GetUsersByIDs but uses ctx for the database calls
+func GetUsersByIDsContext(ctx context.Context, ids []int) (map[int]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.GetUsersByIDsContext(ctx, ids)
+}
+
+// GetUsersByUsernames returns the users with the given usernames of the database
+// pointed to by Filename, keyed by normalized username
+func GetUsersByUsernames(usernames []string) (map[string]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.GetUsersByUsernames(usernames)
+}
+
+// GetUsersByUsernamesContext is like GetUsersByUsernames but uses ctx for the database calls
+func GetUsersByUsernamesContext(ctx context.Context, usernames []string) (map[string]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.GetUsersByUsernamesContext(ctx, usernames)
+}
+
+// SoftDelete marks a user of the database pointed to by Filename as deleted
+func SoftDelete(id int) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.SoftDelete(id)
+}
+
+// SoftDeleteContext is like SoftDelete but uses ctx for the database calls
+func SoftDeleteContext(ctx context.Context, id int) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.SoftDeleteContext(ctx, id)
+}
+
+// Restore undoes SoftDelete for a user of the database pointed to by Filename
+func Restore(id int) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.Restore(id)
+}
+
+// RestoreContext is like Restore but uses ctx for the database calls
+func RestoreContext(ctx context.Context, id int) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.RestoreContext(ctx, id)
+}
+
+// ListUsersIncludingDeleted returns all users of the database pointed to by Filename
+func ListUsersIncludingDeleted() ([]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListUsersIncludingDeleted()
+}
+
+// ListUsersIncludingDeletedContext is like ListUsersIncludingDeleted but uses ctx for the database calls
+func ListUsersIncludingDeletedContext(ctx context.Context) ([]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListUsersIncludingDeletedContext(ctx)
+}
+
+// UpdateUserByUsername updates the Name, Surname and Description of a user
+// of the database pointed to by Filename
+func UpdateUserByUsername(username, name, surname, description string) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.UpdateUserByUsername(username, name, surname, description)
+}
+
+// UpdateUserByUsernameContext is like UpdateUserByUsername but uses ctx for the database calls
+func UpdateUserByUsernameContext(ctx context.Context, username, name, surname, description string) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.UpdateUserByUsernameContext(ctx, username, name, surname, description)
+}
+
+// UpsertUser adds or updates a user of the database pointed to by Filename
+func UpsertUser(d Userdata) (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return -1, err
+	}
+	return db.UpsertUser(d)
+}
+
+// UpsertUserContext is like UpsertUser but uses ctx for the database calls
+func UpsertUserContext(ctx context.Context, d Userdata) (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return -1, err
+	}
+	return db.UpsertUserContext(ctx, d)
+}
+
+// DeleteAllUsers deletes every user of the database pointed to by Filename
+func DeleteAllUsers() (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.DeleteAllUsers()
+}
+
+// DeleteAllUsersContext is like DeleteAllUsers but uses ctx for the database calls
+func DeleteAllUsersContext(ctx context.Context) (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.DeleteAllUsersContext(ctx)
+}
+
+// ListUsersFiltered returns the users of the database pointed to by Filename that match f
+func ListUsersFiltered(f UserFilter) ([]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListUsersFiltered(f)
+}
+
+// ListUsersFilteredContext is like ListUsersFiltered but uses ctx for the database calls
+func ListUsersFilteredContext(ctx context.Context, f UserFilter) ([]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListUsersFilteredContext(ctx, f)
+}
+
+// ListUsersFunc calls fn for every user of the database pointed to by Filename
+func ListUsersFunc(fn func(Userdata) error) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.ListUsersFunc(fn)
+}
+
+// ListUsersFuncContext is like ListUsersFunc but uses ctx for the database calls
+func ListUsersFuncContext(ctx context.Context, fn func(Userdata) error) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.ListUsersFuncContext(ctx, fn)
+}
+
+// CountUsersFiltered returns the number of users of the database pointed to by Filename that match f
+func CountUsersFiltered(f UserFilter) (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.CountUsersFiltered(f)
+}
+
+// CountUsersFilteredContext is like CountUsersFiltered but uses ctx for the database calls
+func CountUsersFilteredContext(ctx context.Context, f UserFilter) (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.CountUsersFilteredContext(ctx, f)
+}
+
+// DeleteUsers deletes the users with the given IDs from the database pointed to by Filename
+func DeleteUsers(ids []int) (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.DeleteUsers(ids)
+}
+
+// DeleteUsersContext is like DeleteUsers but uses ctx for the database calls
+func DeleteUsersContext(ctx context.Context, ids []int) (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.DeleteUsersContext(ctx, ids)
+}
+
+// Rename moves the database pointed to by Filename to newPath
+// and sets Filename to newPath once the file has been moved
+func Rename(newPath string) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	err = db.Rename(newPath)
+	if db.filename == newPath {
+		Filename = newPath
+	}
+	return err
+}
+
+// FindOrphanedUserdata returns the UserIDs of the orphaned Userdata rows
+// of the database pointed to by Filename
+func FindOrphanedUserdata() ([]int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.FindOrphanedUserdata()
+}
+
+// FindOrphanedUserdataContext is like FindOrphanedUserdata but uses ctx for the database calls
+func FindOrphanedUserdataContext(ctx context.Context) ([]int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.FindOrphanedUserdataContext(ctx)
+}
+
+// CleanupOrphans deletes the orphaned Userdata rows of the database pointed to by Filename
+func CleanupOrphans() (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.CleanupOrphans()
+}
+
+// CleanupOrphansContext is like CleanupOrphans but uses ctx for the database calls
+func CleanupOrphansContext(ctx context.Context) (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.CleanupOrphansContext(ctx)
+}
+
+// EnsureUserdata adds the missing Userdata rows of the database pointed to by Filename
+func EnsureUserdata() (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.EnsureUserdata()
+}
+
+// EnsureUserdataContext is like EnsureUserdata but uses ctx for the database calls
+func EnsureUserdataContext(ctx context.Context) (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.EnsureUserdataContext(ctx)
+}
+
+// CountUsersWithoutUserdata returns the number of users without a Userdata row
+// of the database pointed to by Filename
+func CountUsersWithoutUserdata() (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.CountUsersWithoutUserdata()
+}
+
+// CountUsersWithoutUserdataContext is like CountUsersWithoutUserdata but uses ctx for the database calls
+func CountUsersWithoutUserdataContext(ctx context.Context) (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.CountUsersWithoutUserdataContext(ctx)
+}
+
+// NormalizeExistingUsernames rewrites the usernames that are not normalized
+// in the database pointed to by Filename
+func NormalizeExistingUsernames() (int, []string, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, nil, err
+	}
+	return db.NormalizeExistingUsernames()
+}
+
+// NormalizeExistingUsernamesContext is like NormalizeExistingUsernames but uses ctx for the database calls
+func NormalizeExistingUsernamesContext(ctx context.Context) (int, []string, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, nil, err
+	}
+	return db.NormalizeExistingUsernamesContext(ctx)
+}
+
+// VerifyIntegrity returns the problems found in the database pointed to by Filename
+func VerifyIntegrity() ([]string, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.VerifyIntegrity()
+}
+
+// VerifyIntegrityContext is like VerifyIntegrity but uses ctx for the database calls
+func VerifyIntegrityContext(ctx context.Context) ([]string, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.VerifyIntegrityContext(ctx)
+}
+
+// GetSchemaVersion returns the schema version of the database pointed to by Filename
+// It cannot be called SchemaVersion, since that is the version Migrate brings a database to
+func GetSchemaVersion() (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.SchemaVersion()
+}
+
+// GetSchemaVersionContext is like GetSchemaVersion but uses ctx for the database calls
+func GetSchemaVersionContext(ctx context.Context) (int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, err
+	}
+	return db.SchemaVersionContext(ctx)
+}
+
+// GetPackageVersion returns the package version that last migrated the database pointed to by Filename
+func GetPackageVersion() (string, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return "", err
+	}
+	return db.PackageVersion()
+}
+
+// GetPackageVersionContext is like GetPackageVersion but uses ctx for the database calls
+func GetPackageVersionContext(ctx context.Context) (string, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return "", err
+	}
+	return db.PackageVersionContext(ctx)
+}
+
+// UpsertUsers adds or updates users of the database pointed to by Filename
+func UpsertUsers(users []Userdata) (added, updated int, err error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, 0, err
+	}
+	return db.UpsertUsers(users)
+}
+
+// UpsertUsersContext is like UpsertUsers but uses ctx for the database calls
+func UpsertUsersContext(ctx context.Context, users []Userdata) (added, updated int, err error) {
+	db, err := defaultDB()
+	if err != nil {
+		return 0, 0, err
+	}
+	return db.UpsertUsersContext(ctx, users)
+}
+
+// ListUsernames returns the usernames of the database pointed to by Filename
+func ListUsernames() ([]string, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListUsernames()
+}
+
+// ListUsernamesContext is like ListUsernames but uses ctx for the database calls
+func ListUsernamesContext(ctx context.Context) ([]string, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListUsernamesContext(ctx)
+}
+
+// ListUsersByUsernameMap returns all users of the database pointed to by Filename
+// keyed by normalized username
+func ListUsersByUsernameMap() (map[string]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListUsersByUsernameMap()
+}
+
+// ListUsersByUsernameMapContext is like ListUsersByUsernameMap but uses ctx for the database calls
+func ListUsersByUsernameMapContext(ctx context.Context) (map[string]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListUsersByUsernameMapContext(ctx)
+}
+
+// ListUsersCreatedBetween returns the users of the database pointed to by Filename
+// that were created at or after start and before end
+func ListUsersCreatedBetween(start, end time.Time) ([]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListUsersCreatedBetween(start, end)
+}
+
+// ListUsersCreatedBetweenContext is like ListUsersCreatedBetween but uses ctx for the database calls
+func ListUsersCreatedBetweenContext(ctx context.Context, start, end time.Time) ([]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListUsersCreatedBetweenContext(ctx, start, end)
+}
+
+// ListRecentUsers returns the n newest users of the database pointed to by Filename
+func ListRecentUsers(n int) ([]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListRecentUsers(n)
+}
+
+// ListRecentUsersContext is like ListRecentUsers but uses ctx for the database calls
+func ListRecentUsersContext(ctx context.Context, n int) ([]Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.ListRecentUsersContext(ctx, n)
+}
+
+// SeedTestUsers adds n users with predictable data to the database pointed to by Filename
+func SeedTestUsers(n int) ([]int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.SeedTestUsers(n)
+}
+
+// SeedTestUsersContext is like SeedTestUsers but uses ctx for the database calls
+func SeedTestUsersContext(ctx context.Context, n int) ([]int, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.SeedTestUsersContext(ctx, n)
+}
+
+// GetUserData returns the Userdata row of a user of the database pointed to by Filename
+func GetUserData(userID int) (Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return Userdata{}, err
+	}
+	return db.GetUserData(userID)
+}
+
+// GetUserDataContext is like GetUserData but uses ctx for the database calls
+func GetUserDataContext(ctx context.Context, userID int) (Userdata, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return Userdata{}, err
+	}
+	return db.GetUserDataContext(ctx, userID)
+}
+
+// MergeUsers merges the user removeID into the user keepID and deletes removeID
+// in the database pointed to by Filename
+func MergeUsers(keepID, removeID int) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.MergeUsers(keepID, removeID)
+}
+
+// MergeUsersContext is like MergeUsers but uses ctx for the database calls
+func MergeUsersContext(ctx context.Context, keepID, removeID int) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.MergeUsersContext(ctx, keepID, removeID)
+}
+
+// SetDescription updates only the Description of a user of the database pointed to by Filename
+func SetDescription(id int, description string) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.SetDescription(id, description)
+}
+
+// SetDescriptionContext is like SetDescription but uses ctx for the database calls
+func SetDescriptionContext(ctx context.Context, id int, description string) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.SetDescriptionContext(ctx, id, description)
+}
+
+// UpdateName updates the Name and Surname of a user of the database pointed to by Filename
+func UpdateName(id int, name, surname string) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.UpdateName(id, name, surname)
+}
+
+// UpdateNameContext is like UpdateName but uses ctx for the database calls
+func UpdateNameContext(ctx context.Context, id int, name, surname string) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.UpdateNameContext(ctx, id, name, surname)
+}
+
+// SetPassword sets the password of a user of the database pointed to by Filename
+func SetPassword(id int, plaintext string) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.SetPassword(id, plaintext)
+}
+
+// SetPasswordContext is like SetPassword but uses ctx for the database calls
+func SetPasswordContext(ctx context.Context, id int, plaintext string) error {
+	db, err := defaultDB()
+	if err != nil {
+		return err
+	}
+	return db.SetPasswordContext(ctx, id, plaintext)
+}
+
+// VerifyPassword checks the password of a user of the database pointed to by Filename
+func VerifyPassword(username, plaintext string) (bool, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return false, err
+	}
+	return db.VerifyPassword(username, plaintext)
+}
+
+// VerifyPasswordContext is like VerifyPassword but uses ctx for the database calls
+func VerifyPasswordContext(ctx context.Context, username, plaintext string) (bool, error) {
+	db, err := defaultDB()
+	if err != nil {
+		return false, err
+	}
+	return db.VerifyPasswordContext(ctx, username, plaintext)
+}
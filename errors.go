@@ -0,0 +1,54 @@
+package sqlite06
+
+import "fmt"
+
+// UserExistsError is returned when a username is already taken
+// It matches ErrUserExists with errors.Is, use errors.As to get the username.
+type UserExistsError struct {
+	Username string
+}
+
+func (e *UserExistsError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrUserExists, e.Username)
+}
+
+func (e *UserExistsError) Unwrap() error {
+	return ErrUserExists
+}
+
+// UserNotFoundError is returned when there is no user with the ID, the username
+// or the email that was asked for. Only the field that was looked up is set.
+// It matches ErrUserNotFound with errors.Is, use errors.As to get the details.
+type UserNotFoundError struct {
+	ID       int
+	Username string
+	Email    string
+
+	// err is the error of the failed lookup, sql.ErrNoRows for the single user lookups
+	err error
+}
+
+func (e *UserNotFoundError) Error() string {
+	var msg string
+	switch {
+	case e.Username != "":
+		msg = fmt.Sprintf("%v: %s", ErrUserNotFound, e.Username)
+	case e.Email != "":
+		msg = fmt.Sprintf("%v: %s", ErrUserNotFound, e.Email)
+	case e.ID != 0:
+		msg = fmt.Sprintf("%v: ID %d", ErrUserNotFound, e.ID)
+	default:
+		msg = ErrUserNotFound.Error()
+	}
+	if e.err != nil {
+		msg += ": " + e.err.Error()
+	}
+	return msg
+}
+
+func (e *UserNotFoundError) Unwrap() []error {
+	if e.err == nil {
+		return []error{ErrUserNotFound}
+	}
+	return []error{ErrUserNotFound, e.err}
+}
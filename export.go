@@ -0,0 +1,101 @@
+package sqlite06
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+)
+
+// ExportJSON writes all users, ordered by ID, to w as a JSON array of Userdata objects
+// Soft deleted users are left out, like in ListUsers.
+// Users are encoded one at a time as they are read from the database,
+// so the whole table is never held in memory.
+func (db *DB) ExportJSON(w io.Writer) error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.ExportJSONContext(ctx, w)
+}
+
+// ExportJSONContext is like ExportJSON but uses ctx for the database calls
+func (db *DB) ExportJSONContext(ctx context.Context, w io.Writer) (err error) {
+	defer observe("ExportJSON", time.Now(), &err)
+	_, err = io.WriteString(w, "[")
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	first := true
+	err = db.eachUser(ctx, func(d Userdata) error {
+		if !first {
+			_, err := io.WriteString(w, ",")
+			if err != nil {
+				return err
+			}
+		}
+		first = false
+		return encoder.Encode(d)
+	}, selectUsers+` WHERE `+notDeleted+` ORDER BY Users.ID`)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "]\n")
+	return err
+}
+
+// ExportUserJSON writes the user with the given ID to w as a single JSON
+// object, encoded like the elements of ExportJSON. Soft deleted users are
+// exported too.
+// Returns ErrUserNotFound if there is no user with that ID
+func (db *DB) ExportUserJSON(id int, w io.Writer) error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.ExportUserJSONContext(ctx, id, w)
+}
+
+// ExportUserJSONContext is like ExportUserJSON but uses ctx for the database calls
+func (db *DB) ExportUserJSONContext(ctx context.Context, id int, w io.Writer) (err error) {
+	defer observe("ExportUserJSON", time.Now(), &err)
+	user, err := db.GetUserByIDContext(ctx, id)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(user)
+}
+
+// csvHeader is the header row written by ExportCSV
+var csvHeader = []string{"ID", "Username", "Name", "Surname", "Description"}
+
+// ExportCSV writes all users, ordered by ID, to w as CSV with a header row
+// Soft deleted users are left out, like in ListUsers.
+// encoding/csv takes care of quoting commas, quotes and newlines in the fields.
+func (db *DB) ExportCSV(w io.Writer) error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.ExportCSVContext(ctx, w)
+}
+
+// ExportCSVContext is like ExportCSV but uses ctx for the database calls
+func (db *DB) ExportCSVContext(ctx context.Context, w io.Writer) (err error) {
+	defer observe("ExportCSV", time.Now(), &err)
+	writer := csv.NewWriter(w)
+	err = writer.Write(csvHeader)
+	if err != nil {
+		return err
+	}
+
+	// csv.Writer is buffered, rows reach w in chunks while the users are read
+	err = db.eachUser(ctx, func(d Userdata) error {
+		return writer.Write([]string{strconv.Itoa(d.ID), d.Username, d.Name, d.Surname, d.Description})
+	}, selectUsers+` WHERE `+notDeleted+` ORDER BY Users.ID`)
+	if err != nil {
+		return err
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
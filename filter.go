@@ -0,0 +1,106 @@
+package sqlite06
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// UserFilter selects users for ListUsersFiltered
+// Every field left at its zero value does not constrain the result.
+// Soft deleted users are always left out, like in ListUsers.
+type UserFilter struct {
+	// UsernamePrefix matches the usernames that start with it, after the
+	// same normalization that is applied to stored usernames
+	UsernamePrefix string
+	// Surname matches the users with exactly that surname, ignoring case
+	Surname string
+	// MinID and MaxID bound the user IDs, both bounds are inclusive
+	MinID int
+	MaxID int
+	// Limit is the largest number of users returned, it is capped to
+	// MaxPageSize. Offset skips that many users, ordered by ID.
+	Limit  int
+	Offset int
+}
+
+// where returns the WHERE clause that selects the users matching f
+// together with its arguments
+func (db *DB) where(f UserFilter) (string, []any) {
+	conditions := []string{notDeleted}
+	var args []any
+
+	if f.UsernamePrefix != "" {
+		prefix := db.normalizeUsername(f.UsernamePrefix)
+		// LIKE ignores case for ASCII, which is wrong with CaseSensitiveUsernames
+		conditions = append(conditions, `substr(Username, 1, ?) = ?`)
+		args = append(args, utf8.RuneCountInString(prefix), prefix)
+	}
+	if f.Surname != "" {
+		conditions = append(conditions, `Userdata.Surname = ? COLLATE NOCASE`)
+		args = append(args, f.Surname)
+	}
+	if f.MinID != 0 {
+		conditions = append(conditions, `Users.ID >= ?`)
+		args = append(args, f.MinID)
+	}
+	if f.MaxID != 0 {
+		conditions = append(conditions, `Users.ID <= ?`)
+		args = append(args, f.MaxID)
+	}
+	return ` WHERE ` + strings.Join(conditions, ` AND `), args
+}
+
+// ListUsersFiltered returns the users matching f ordered by ID
+// Returns ErrInvalidLimit if f.Limit is negative
+func (db *DB) ListUsersFiltered(f UserFilter) ([]Userdata, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.ListUsersFilteredContext(ctx, f)
+}
+
+// ListUsersFilteredContext is like ListUsersFiltered but uses ctx for the database calls
+func (db *DB) ListUsersFilteredContext(ctx context.Context, f UserFilter) (_ []Userdata, err error) {
+	defer observe("ListUsersFiltered", time.Now(), &err)
+	if f.Limit < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidLimit, f.Limit)
+	}
+	limit := f.Limit
+	if limit == 0 {
+		// SQLite takes a negative LIMIT as no limit, and OFFSET needs a LIMIT
+		limit = -1
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	offset := max(f.Offset, 0)
+
+	where, args := db.where(f)
+	statement := selectUsers + where + ` ORDER BY Users.ID LIMIT ? OFFSET ?`
+	return db.queryUsers(ctx, statement, append(args, limit, offset)...)
+}
+
+// CountUsersFiltered returns the number of users matching f
+// f.Limit and f.Offset are ignored, so that together with ListUsersFiltered
+// it gives the total behind a page.
+func (db *DB) CountUsersFiltered(f UserFilter) (int, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.CountUsersFilteredContext(ctx, f)
+}
+
+// CountUsersFilteredContext is like CountUsersFiltered but uses ctx for the database calls
+func (db *DB) CountUsersFilteredContext(ctx context.Context, f UserFilter) (_ int, err error) {
+	defer observe("CountUsersFiltered", time.Now(), &err)
+	where, args := db.where(f)
+	statement := `SELECT COUNT(*) FROM Users LEFT JOIN Userdata ON Users.ID = Userdata.UserID` + where
+
+	var count int
+	err = db.queryRow(ctx, statement, args...).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
@@ -2,4 +2,7 @@ module github.com/tunacinsoy/sqlite06
 
 go 1.23.2
 
-require github.com/mattn/go-sqlite3 v1.14.24
+require (
+	github.com/mattn/go-sqlite3 v1.14.24
+	golang.org/x/crypto v0.32.0
+)
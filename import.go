@@ -0,0 +1,178 @@
+package sqlite06
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ImportJSON reads a JSON array of Userdata objects from r, as written by
+// ExportJSON, and adds them to the database in a single transaction.
+// The IDs and timestamps of the input are ignored, users get new ones.
+// Users whose username already exists are skipped, any invalid user aborts
+// the whole import. Returns the number of users that have been added.
+func (db *DB) ImportJSON(r io.Reader) (int, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.ImportJSONContext(ctx, r)
+}
+
+// ImportJSONContext is like ImportJSON but uses ctx for the database calls
+func (db *DB) ImportJSONContext(ctx context.Context, r io.Reader) (_ int, err error) {
+	defer observe("ImportJSON", time.Now(), &err)
+	var users []Userdata
+	err = json.NewDecoder(r).Decode(&users)
+	if err != nil {
+		return 0, fmt.Errorf("decoding users: %w", err)
+	}
+
+	// Checked up front, since AddUsers would stop at the first invalid user
+	// with an error that does not say which one it was
+	for i := range users {
+		err = db.validate(&users[i])
+		if err != nil {
+			return 0, fmt.Errorf("user %d of the input: %w", i, err)
+		}
+	}
+
+	ids, err := db.AddUsersContext(ctx, users)
+	if err != nil {
+		return 0, err
+	}
+	return countAdded(ids), nil
+}
+
+// countAdded returns how many of the IDs returned by AddUsers belong to
+// users that have actually been added
+func countAdded(ids []int) int {
+	added := 0
+	for _, id := range ids {
+		if id != -1 {
+			added++
+		}
+	}
+	return added
+}
+
+// ImportCSV reads users from r as CSV, as written by ExportCSV, and adds
+// them to the database in a single transaction.
+// The first row is a header, columns are matched by name: Username is required,
+// Name, Surname, Description and Email are optional, any other column
+// (ID included) is ignored.
+// A row that cannot be added, because it is invalid or its username already
+// exists, does not stop the import. Returns the number of users that have
+// been added, together with an error listing every row that failed.
+func (db *DB) ImportCSV(r io.Reader) (int, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.ImportCSVContext(ctx, r)
+}
+
+// ImportCSVContext is like ImportCSV but uses ctx for the database calls
+func (db *DB) ImportCSVContext(ctx context.Context, r io.Reader) (_ int, err error) {
+	defer observe("ImportCSV", time.Now(), &err)
+	reader := csv.NewReader(r)
+	// Spreadsheets often drop empty trailing cells, missing fields are empty
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return 0, fmt.Errorf("reading CSV header: %w", err)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	if _, ok := columns["Username"]; !ok {
+		return 0, errors.New("CSV header has no Username column")
+	}
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return record[i]
+	}
+
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrInsert, err)
+	}
+	defer tx.Rollback()
+
+	inserter, err := db.newBatchInserter(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	defer inserter.close()
+
+	added := 0
+	var rowErrs []error
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// A malformed record can still be skipped, the reader goes on
+			// with the next line
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				rowErrs = append(rowErrs, err)
+				continue
+			}
+			return 0, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		d := Userdata{
+			Username:    field(record, "Username"),
+			Name:        field(record, "Name"),
+			Surname:     field(record, "Surname"),
+			Description: field(record, "Description"),
+			Email:       field(record, "Email"),
+		}
+		err = insertSavepoint(ctx, tx, func() error {
+			// The CSV has no passwords, there is nothing to hash
+			_, err := inserter.insert(ctx, d, sql.NullString{})
+			return err
+		})
+		if err != nil {
+			rowErrs = append(rowErrs, fmt.Errorf("line %d: %w", line, db.readOnlyErr(err)))
+			continue
+		}
+		added++
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrInsert, err)
+	}
+	return added, errors.Join(rowErrs...)
+}
+
+// insertSavepoint runs fn within a savepoint of tx, so that a failing fn
+// undoes only its own changes and the transaction can go on
+func insertSavepoint(ctx context.Context, tx *sql.Tx, fn func() error) error {
+	_, err := tx.ExecContext(ctx, `SAVEPOINT import_row`)
+	if err != nil {
+		return err
+	}
+
+	err = fn()
+	if err != nil {
+		_, rollbackErr := tx.ExecContext(ctx, `ROLLBACK TO import_row`)
+		if rollbackErr != nil {
+			return errors.Join(err, rollbackErr)
+		}
+	}
+
+	_, releaseErr := tx.ExecContext(ctx, `RELEASE import_row`)
+	return errors.Join(err, releaseErr)
+}
@@ -0,0 +1,29 @@
+package sqlite06
+
+import (
+	"io"
+	"log"
+	"sync/atomic"
+)
+
+// logger receives the diagnostic messages of this package.
+// A library should not write to stdout on its own, so it discards everything by default.
+var logger atomic.Pointer[log.Logger]
+
+func init() {
+	logger.Store(log.New(io.Discard, "", 0))
+}
+
+// SetLogger makes the package write its diagnostic messages to l
+// Passing nil disables logging again
+func SetLogger(l *log.Logger) {
+	if l == nil {
+		l = log.New(io.Discard, "", 0)
+	}
+	logger.Store(l)
+}
+
+// logf writes a diagnostic message to the current logger
+func logf(format string, v ...any) {
+	logger.Load().Printf(format, v...)
+}
@@ -0,0 +1,136 @@
+package sqlite06
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrBackupExists is returned by Backup when the destination file already exists
+var ErrBackupExists = errors.New("backup destination already exists")
+
+// Vacuum rebuilds the database file, which gives the space of deleted rows
+// back to the file system and defragments the tables.
+// VACUUM cannot run inside a transaction and needs exclusive access to the
+// database, so it fails with SQLITE_BUSY while another connection writes.
+// It also needs up to twice the size of the database as free disk space.
+func (db *DB) Vacuum() error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.VacuumContext(ctx)
+}
+
+// VacuumContext is like Vacuum but uses ctx for the database calls
+func (db *DB) VacuumContext(ctx context.Context) (err error) {
+	defer observe("Vacuum", time.Now(), &err)
+	// Runs on a connection of its own, not inside any transaction
+	_, err = db.exec(ctx, `VACUUM`)
+	if err != nil {
+		return fmt.Errorf("vacuum: %w", err)
+	}
+	return nil
+}
+
+// Backup writes a consistent copy of the database to destPath
+// It uses VACUUM INTO, so it can run while the database is in use and the copy
+// is compacted as well. Returns ErrBackupExists if destPath already exists,
+// unless overwrite is true, in which case the old file is replaced.
+func (db *DB) Backup(destPath string, overwrite bool) error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.BackupContext(ctx, destPath, overwrite)
+}
+
+// BackupContext is like Backup but uses ctx for the database calls
+func (db *DB) BackupContext(ctx context.Context, destPath string, overwrite bool) (err error) {
+	defer observe("Backup", time.Now(), &err)
+	_, err = os.Stat(destPath)
+	if err == nil && !overwrite {
+		return fmt.Errorf("%w: %s", ErrBackupExists, destPath)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// VACUUM INTO refuses to write over an existing file, the copy goes to
+	// a temporary file next to destPath which then replaces it in one step
+	tmp, err := os.CreateTemp(filepath.Dir(destPath), filepath.Base(destPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	os.Remove(tmpPath)
+	defer os.Remove(tmpPath)
+
+	_, err = db.exec(ctx, `VACUUM INTO ?`, tmpPath)
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+
+	return os.Rename(tmpPath, destPath)
+}
+
+// Rename moves the database file to newPath and reopens db there
+// The connections are closed first, since an open file cannot be renamed on
+// Windows, and the -wal and -shm files of WAL mode are moved along with it.
+// Returns an error matching os.ErrExist if newPath already exists.
+// If the file cannot be moved, db is reopened at its old path.
+// Rename must not be called while db is used by other goroutines,
+// and other handles to the same file have to be closed beforehand.
+func (db *DB) Rename(newPath string) error {
+	if isMemory(db.filename) {
+		return errors.New("an in-memory database cannot be renamed")
+	}
+	if db.external {
+		return errors.New("a database of NewWithDB cannot be renamed")
+	}
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	_, err := os.Stat(newPath)
+	if err == nil {
+		return fmt.Errorf("%w: %s", os.ErrExist, newPath)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = errors.Join(db.cache.close(), db.conn.Load().Close())
+	if err != nil {
+		return err
+	}
+
+	// If the file cannot be moved it is still where it was,
+	// and db stays usable there
+	filename := db.filename
+	oldPath := filePath(db.filename)
+	err = os.Rename(oldPath, newPath)
+	if err == nil {
+		filename = newPath
+		for _, suffix := range []string{"-wal", "-shm"} {
+			renameErr := os.Rename(oldPath+suffix, newPath+suffix)
+			if renameErr != nil && !errors.Is(renameErr, os.ErrNotExist) {
+				err = errors.Join(err, renameErr)
+			}
+		}
+	}
+
+	conn, openErr := openConnection(filename, db.config)
+	if openErr == nil {
+		openErr = conn.Ping()
+		if openErr != nil {
+			conn.Close()
+		}
+	}
+	if openErr != nil {
+		db.closed.Store(true)
+		return errors.Join(err, fmt.Errorf("%w: %w", ErrConnection, openErr))
+	}
+	db.conn.Store(conn)
+	db.filename = filename
+	return err
+}
@@ -0,0 +1,74 @@
+package sqlite06
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// MergeUsers merges the user with ID removeID into the user with ID keepID
+// and deletes removeID, in a single transaction.
+// The Userdata of keepID wins: only its empty Name, Surname, Description and
+// Email are filled in from removeID. If keepID has no Userdata row, the one
+// of removeID is moved to keepID as a whole. The username, CreatedAt and
+// DeletedAt of keepID are left as they were.
+// Returns ErrUserNotFound if either user does not exist
+func (db *DB) MergeUsers(keepID, removeID int) error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.MergeUsersContext(ctx, keepID, removeID)
+}
+
+// MergeUsersContext is like MergeUsers but uses ctx for the database calls
+func (db *DB) MergeUsersContext(ctx context.Context, keepID, removeID int) (err error) {
+	defer observe("MergeUsers", time.Now(), &err)
+	if keepID == removeID {
+		return errors.New("cannot merge a user into itself")
+	}
+
+	return db.withTx(ctx, nil, func(tx *Tx) error {
+		for _, id := range []int{keepID, removeID} {
+			var found int
+			err := tx.queryRow(`SELECT ID FROM Users WHERE ID = ?`, id).Scan(&found)
+			if errors.Is(err, sql.ErrNoRows) {
+				return &UserNotFoundError{ID: id}
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		var name, surname, description, email sql.NullString
+		err := tx.queryRow(`SELECT Name, Surname, Description, Email FROM Userdata WHERE UserID = ?`, removeID).
+			Scan(&name, &surname, &description, &email)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// Nothing to merge, removeID only has its Users row
+		case err != nil:
+			return err
+		default:
+			res, err := tx.exec(`UPDATE Userdata SET Name = COALESCE(NULLIF(Name, ''), ?),
+                Surname = COALESCE(NULLIF(Surname, ''), ?), Description = COALESCE(NULLIF(Description, ''), ?),
+                Email = COALESCE(NULLIF(Email, ''), ?), UpdatedAt = ? WHERE UserID = ?`,
+				name, surname, description, email, time.Now().Unix(), keepID)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				_, err = tx.exec(`UPDATE Userdata SET UserID = ? WHERE UserID = ?`, keepID, removeID)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		// The Userdata row of removeID, if still there, goes with it
+		_, err = db.deleteUserTx(ctx, tx.tx, removeID)
+		return err
+	})
+}
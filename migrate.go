@@ -0,0 +1,187 @@
+package sqlite06
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// migration is a single versioned step of the schema
+type migration struct {
+	version     int
+	description string
+	apply       func(ctx context.Context, db *DB, tx *sql.Tx) error
+}
+
+// SchemaVersion is the schema version that Migrate brings a database to
+var SchemaVersion = migrations[len(migrations)-1].version
+
+// Version is the version of this package, kept in step with the release tag
+// Migrate stores it in the database when it applies a step, see DB.PackageVersion.
+const Version = "v0.0.1"
+
+// The keys of the Metadata table
+const (
+	schemaVersionKey  = "schema_version"
+	packageVersionKey = "package_version"
+)
+
+// upsertMetadata sets the value of a key of the Metadata table
+const upsertMetadata = `INSERT INTO Metadata (Key, Value) VALUES (?, ?)
+              ON CONFLICT (Key) DO UPDATE SET Value = excluded.Value`
+
+// Migrate upgrades the database to SchemaVersion without dropping any data
+// Each pending step runs in its own transaction together with the update
+// of the stored version, so a failing step leaves the database at the
+// previous version.
+func (db *DB) Migrate() error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.MigrateContext(ctx)
+}
+
+// MigrateContext is like Migrate but uses ctx for the database calls
+func (db *DB) MigrateContext(ctx context.Context) (err error) {
+	defer observe("Migrate", time.Now(), &err)
+	_, err = db.exec(ctx, `CREATE TABLE IF NOT EXISTS Metadata (
+		Key TEXT PRIMARY KEY,
+		Value TEXT
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating Metadata table: %w", err)
+	}
+
+	migrated := false
+	for _, m := range migrations {
+		err = db.retry(ctx, func() error {
+			applied, err := db.applyMigration(ctx, m)
+			migrated = migrated || applied
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+	}
+
+	// An up to date database is not written to, which keeps Migrate a no-op
+	// for it, read-only databases included
+	if !migrated {
+		return nil
+	}
+	stored, err := db.metadata(ctx, packageVersionKey)
+	if err != nil {
+		return fmt.Errorf("reading package version: %w", err)
+	}
+	if stored == Version {
+		return nil
+	}
+	_, err = db.exec(ctx, upsertMetadata, packageVersionKey, Version)
+	if err != nil {
+		return fmt.Errorf("storing package version: %w", err)
+	}
+	return nil
+}
+
+// applyMigration runs m unless the database is already at its version or later
+// and reports whether it did
+func (db *DB) applyMigration(ctx context.Context, m migration) (bool, error) {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// The version is read inside the transaction, so that two processes
+	// migrating the same file do not both apply the step
+	current, err := db.schemaVersionTx(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+	if current >= m.version {
+		return false, nil
+	}
+
+	err = m.apply(ctx, db, tx)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.ExecContext(ctx, db.sql(upsertMetadata), schemaVersionKey, strconv.Itoa(m.version))
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// schemaVersionTx returns the stored schema version, 0 if there is none
+func (db *DB) schemaVersionTx(ctx context.Context, tx *sql.Tx) (int, error) {
+	var value string
+	err := tx.QueryRowContext(ctx, db.sql(`SELECT Value FROM Metadata WHERE Key = ?`), schemaVersionKey).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// SchemaVersion returns the schema version of the database, 0 if it has never
+// been migrated. It is lower than the SchemaVersion variable when the database
+// needs Migrate, and higher when it was written by a newer version of this package.
+func (db *DB) SchemaVersion() (int, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.SchemaVersionContext(ctx)
+}
+
+// SchemaVersionContext is like SchemaVersion but uses ctx for the database calls
+func (db *DB) SchemaVersionContext(ctx context.Context) (_ int, err error) {
+	defer observe("SchemaVersion", time.Now(), &err)
+	value, err := db.metadata(ctx, schemaVersionKey)
+	if err != nil || value == "" {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// PackageVersion returns the Version of this package that last applied
+// a migration step to the database, an empty string if there is none
+func (db *DB) PackageVersion() (string, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.PackageVersionContext(ctx)
+}
+
+// PackageVersionContext is like PackageVersion but uses ctx for the database calls
+func (db *DB) PackageVersionContext(ctx context.Context) (_ string, err error) {
+	defer observe("PackageVersion", time.Now(), &err)
+	return db.metadata(ctx, packageVersionKey)
+}
+
+// metadata returns the value stored under key in the Metadata table,
+// an empty string if there is none
+func (db *DB) metadata(ctx context.Context, key string) (string, error) {
+	exists, err := db.tableExists(ctx, defaultMetadataTable)
+	if err != nil || !exists {
+		return "", err
+	}
+
+	var value string
+	err = db.queryRow(ctx, `SELECT Value FROM Metadata WHERE Key = ?`, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return value, err
+}
+
+// tableExists reports whether table, given by its default name, is in the database
+func (db *DB) tableExists(ctx context.Context, table string) (bool, error) {
+	var n int
+	err := db.queryRow(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`,
+		db.sql(table)).Scan(&n)
+	return n > 0, err
+}
@@ -0,0 +1,37 @@
+package sqlite06
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Observer is called after every operation of a DB with the name of the
+// operation, such as "AddUser" or "ListUsers", how long it took and its
+// error, nil on success. The Context variants report the same name as the
+// plain ones. Operations built on others, like ImportJSON on AddUsers, report
+// each of them. It can be called from many goroutines at once.
+type Observer func(op string, d time.Duration, err error)
+
+// observer is the Observer set with SetObserver, nil if there is none
+var observer atomic.Pointer[Observer]
+
+// SetObserver makes the package call fn after every operation, to collect
+// timings and error rates
+// Passing nil removes the observer again
+func SetObserver(fn Observer) {
+	if fn == nil {
+		observer.Store(nil)
+		return
+	}
+	observer.Store(&fn)
+}
+
+// observe reports the operation op, started at start, to the current observer
+// It is meant to be deferred with a pointer to the named error result.
+func observe(op string, start time.Time, err *error) {
+	fn := observer.Load()
+	if fn == nil {
+		return
+	}
+	(*fn)(op, time.Since(start), *err)
+}
@@ -0,0 +1,106 @@
+package sqlite06
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords are optional: a user added without one has a NULL PasswordHash
+// and VerifyPassword never matches it. Only the bcrypt hash of a password
+// is stored, which takes tens of milliseconds to compute on purpose.
+
+// hashPassword returns the bcrypt hash of plaintext to be stored in
+// Users.PasswordHash, NULL for an empty plaintext
+func hashPassword(plaintext string) (sql.NullString, error) {
+	if plaintext == "" {
+		return sql.NullString{}, nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(plaintext), bcrypt.DefaultCost)
+	if err != nil {
+		// bcrypt only uses the first 72 bytes and rejects longer passwords
+		return sql.NullString{}, fmt.Errorf("%w: %w", ErrInvalidPassword, err)
+	}
+	return sql.NullString{String: string(hash), Valid: true}, nil
+}
+
+// hashPasswords returns the hashes of the passwords of users, in the same order
+// The functions that add users call it before they begin their transaction,
+// so that bcrypt does not hold the write lock.
+func hashPasswords(users []Userdata) ([]sql.NullString, error) {
+	hashes := make([]sql.NullString, len(users))
+	for i, d := range users {
+		var err error
+		hashes[i], err = hashPassword(d.Password)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+// SetPassword stores the hash of plaintext as the password of the user
+// with the given ID, replacing the previous one
+// Returns ErrInvalidPassword if plaintext is empty or longer than 72 bytes
+// and ErrUserNotFound if there is no user with that ID
+func (db *DB) SetPassword(id int, plaintext string) error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.SetPasswordContext(ctx, id, plaintext)
+}
+
+// SetPasswordContext is like SetPassword but uses ctx for the database calls
+func (db *DB) SetPasswordContext(ctx context.Context, id int, plaintext string) (err error) {
+	defer observe("SetPassword", time.Now(), &err)
+	if plaintext == "" {
+		return fmt.Errorf("%w: password is empty", ErrInvalidPassword)
+	}
+	hash, err := hashPassword(plaintext)
+	if err != nil {
+		return err
+	}
+	return db.updateUsersRow(ctx, id, `UPDATE Users SET PasswordHash = ? WHERE ID = ?`, hash, id)
+}
+
+// VerifyPassword reports whether plaintext is the password of the user with
+// the given username. It is false for users without a password and for
+// soft deleted users.
+// Returns ErrUserNotFound if there is no such user
+func (db *DB) VerifyPassword(username, plaintext string) (bool, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.VerifyPasswordContext(ctx, username, plaintext)
+}
+
+// VerifyPasswordContext is like VerifyPassword but uses ctx for the database calls
+func (db *DB) VerifyPasswordContext(ctx context.Context, username, plaintext string) (_ bool, err error) {
+	defer observe("VerifyPassword", time.Now(), &err)
+	username = db.normalizeUsername(username)
+
+	var hash sql.NullString
+	var deletedAt sql.NullInt64
+	statement := `SELECT PasswordHash, DeletedAt FROM Users WHERE Username = ?`
+	err = db.queryRow(ctx, statement, username).Scan(&hash, &deletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, &UserNotFoundError{Username: username, err: err}
+	}
+	if err != nil {
+		return false, err
+	}
+	if !hash.Valid || deletedAt.Valid {
+		return false, nil
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hash.String), []byte(plaintext))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
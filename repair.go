@@ -0,0 +1,247 @@
+package sqlite06
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Databases written by old versions of this package, which did not keep
+// Users and Userdata in step, can be checked and repaired with the functions below.
+// Migrate already drops orphaned Userdata rows when it adds the foreign key.
+
+// FindOrphanedUserdata returns the UserIDs of the Userdata rows that have no Users row,
+// in ascending order
+func (db *DB) FindOrphanedUserdata() ([]int, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.FindOrphanedUserdataContext(ctx)
+}
+
+// FindOrphanedUserdataContext is like FindOrphanedUserdata but uses ctx for the database calls
+func (db *DB) FindOrphanedUserdataContext(ctx context.Context) (_ []int, err error) {
+	defer observe("FindOrphanedUserdata", time.Now(), &err)
+	statement := `SELECT DISTINCT Userdata.UserID FROM Userdata
+              LEFT JOIN Users ON Users.ID = Userdata.UserID
+              WHERE Users.ID IS NULL ORDER BY Userdata.UserID`
+	rows, err := db.query(ctx, statement)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// CleanupOrphans deletes the Userdata rows that have no Users row
+// Returns the number of rows that were deleted
+func (db *DB) CleanupOrphans() (int, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.CleanupOrphansContext(ctx)
+}
+
+// CleanupOrphansContext is like CleanupOrphans but uses ctx for the database calls
+func (db *DB) CleanupOrphansContext(ctx context.Context) (_ int, err error) {
+	defer observe("CleanupOrphans", time.Now(), &err)
+	var deleted int64
+	err = db.destructiveTx(ctx, func(tx *Tx) error {
+		res, err := tx.exec(`DELETE FROM Userdata WHERE UserID NOT IN (SELECT ID FROM Users)`)
+		if err != nil {
+			return err
+		}
+		deleted, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted), nil
+}
+
+// CountUsersWithoutUserdata returns the number of users, soft deleted ones
+// included, that have no Userdata row. It is the same as Stats.UsersWithoutUserdata.
+func (db *DB) CountUsersWithoutUserdata() (int, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.CountUsersWithoutUserdataContext(ctx)
+}
+
+// CountUsersWithoutUserdataContext is like CountUsersWithoutUserdata but uses ctx for the database calls
+func (db *DB) CountUsersWithoutUserdataContext(ctx context.Context) (_ int, err error) {
+	defer observe("CountUsersWithoutUserdata", time.Now(), &err)
+	statement := `SELECT COUNT(*) FROM Users LEFT JOIN Userdata ON Users.ID = Userdata.UserID
+              WHERE Userdata.UserID IS NULL`
+	var count int
+	err = db.queryRow(ctx, statement).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// EnsureUserdata adds an empty Userdata row for every user that has none,
+// the users counted by Stats.UsersWithoutUserdata
+// Returns the number of rows that were added
+func (db *DB) EnsureUserdata() (int, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.EnsureUserdataContext(ctx)
+}
+
+// EnsureUserdataContext is like EnsureUserdata but uses ctx for the database calls
+func (db *DB) EnsureUserdataContext(ctx context.Context) (_ int, err error) {
+	defer observe("EnsureUserdata", time.Now(), &err)
+	statement := `INSERT INTO Userdata (UserID, Name, Surname, Description, Email, CreatedAt, UpdatedAt)
+              SELECT ID, '', '', '', '', ?, ? FROM Users
+              WHERE NOT EXISTS (SELECT 1 FROM Userdata WHERE Userdata.UserID = Users.ID)`
+	now := time.Now().Unix()
+	res, err := db.exec(ctx, statement, now, now)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// NormalizeExistingUsernames rewrites the stored usernames that do not follow
+// the normalization of normalizeUsername, like the mixed-case or padded ones
+// of old versions, in a single transaction. Usernames that would end up equal
+// to another one, or empty, are left as they are and returned in conflicts,
+// sorted, to be resolved by hand, for instance with UpdateUsername or
+// MergeUsers. fixed is the number of usernames that were rewritten.
+// A database holding such usernames cannot be migrated to the
+// case-insensitive index, so this has to run before Migrate.
+func (db *DB) NormalizeExistingUsernames() (fixed int, conflicts []string, err error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.NormalizeExistingUsernamesContext(ctx)
+}
+
+// NormalizeExistingUsernamesContext is like NormalizeExistingUsernames but uses ctx for the database calls
+func (db *DB) NormalizeExistingUsernamesContext(ctx context.Context) (fixed int, conflicts []string, err error) {
+	defer observe("NormalizeExistingUsernames", time.Now(), &err)
+	err = db.withTx(ctx, nil, func(tx *Tx) error {
+		fixed, conflicts = 0, nil
+
+		type user struct {
+			id       int
+			username string
+		}
+		// The users by normalized username
+		byName := map[string][]user{}
+		rows, err := tx.tx.QueryContext(ctx, db.sql(`SELECT ID, Username FROM Users`))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var u user
+			err = rows.Scan(&u.id, &u.username)
+			if err != nil {
+				return err
+			}
+			normalized := db.normalizeUsername(u.username)
+			byName[normalized] = append(byName[normalized], u)
+		}
+		err = rows.Err()
+		if err != nil {
+			return err
+		}
+		rows.Close()
+
+		// Only the usernames of a group of their own are rewritten, so that
+		// no update can hit the unique index
+		for normalized, users := range byName {
+			if len(users) > 1 || normalized == "" {
+				for _, u := range users {
+					conflicts = append(conflicts, u.username)
+				}
+				continue
+			}
+			if users[0].username == normalized {
+				continue
+			}
+			_, err = tx.exec(`UPDATE Users SET Username = ? WHERE ID = ?`, normalized, users[0].id)
+			if err != nil {
+				return err
+			}
+			fixed++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	slices.Sort(conflicts)
+	return fixed, conflicts, nil
+}
+
+// VerifyIntegrity checks the whole database for problems: corruption found
+// by PRAGMA integrity_check, orphaned Userdata rows and users without a
+// Userdata row. It returns a description of each problem, the slice is
+// empty if the database is healthy. The error is only for failing checks.
+func (db *DB) VerifyIntegrity() ([]string, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.VerifyIntegrityContext(ctx)
+}
+
+// VerifyIntegrityContext is like VerifyIntegrity but uses ctx for the database calls
+func (db *DB) VerifyIntegrityContext(ctx context.Context) (_ []string, err error) {
+	defer observe("VerifyIntegrity", time.Now(), &err)
+	problems := []string{}
+
+	// integrity_check returns a single "ok" row for a sound database,
+	// a row per problem otherwise
+	rows, err := db.query(ctx, `PRAGMA integrity_check`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var result string
+		err = rows.Scan(&result)
+		if err != nil {
+			return nil, err
+		}
+		if result != "ok" {
+			problems = append(problems, "integrity check: "+result)
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	orphans, err := db.FindOrphanedUserdataContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(orphans) > 0 {
+		problems = append(problems, fmt.Sprintf("Userdata rows without a Users row, UserIDs %v", orphans))
+	}
+
+	missing, err := db.CountUsersWithoutUserdataContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if missing > 0 {
+		problems = append(problems, fmt.Sprintf("users without a Userdata row: %d", missing))
+	}
+	return problems, nil
+}
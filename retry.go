@@ -0,0 +1,134 @@
+package sqlite06
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// defaultRetryDelay is the first wait between retries when Config.RetryDelay is zero
+const defaultRetryDelay = 10 * time.Millisecond
+
+// isBusy reports whether err means that another connection held a lock
+// the operation needed, so that running it again later may succeed
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+}
+
+// retry runs fn and runs it again while it fails with SQLITE_BUSY or SQLITE_LOCKED,
+// or once after a reconnect,
+// at most Config.MaxRetries more times. The wait doubles after every attempt.
+// fn has to be safe to run again, which means that it has to do all its
+// writes in a single statement or a single transaction.
+func (db *DB) retry(ctx context.Context, fn func() error) error {
+	delay := db.config.RetryDelay
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+
+	conn := db.conn.Load()
+	err := fn()
+	if db.reconnect(conn, err) {
+		err = fn()
+	}
+	for attempt := 0; attempt < db.config.MaxRetries && isBusy(err); attempt++ {
+		logf("database is busy, retrying in %v: %v", delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+		delay *= 2
+		err = fn()
+	}
+	return db.readOnlyErr(err)
+}
+
+// ping checks that conn can be used, trying again for up to Config.OpenTimeout
+// with the same doubling delay as retry. Returns the error of the last attempt.
+func ping(conn *sql.DB, config Config) error {
+	delay := config.RetryDelay
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+
+	deadline := time.Now().Add(config.OpenTimeout)
+	for {
+		err := conn.Ping()
+		if err == nil || time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		logf("opening database failed, retrying in %v: %v", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// readOnlyErr marks err with ErrReadOnly if it is the failure of a write
+// to a database opened with Config.ReadOnly
+func (db *DB) readOnlyErr(err error) error {
+	var sqliteErr sqlite3.Error
+	if db.config.ReadOnly && errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrReadonly {
+		return fmt.Errorf("%w: %w", ErrReadOnly, err)
+	}
+	return err
+}
+
+// isBroken reports whether err means that the database file cannot be used
+// through the current connections any more, for instance because it was
+// replaced, moved or its disk was remounted
+func isBroken(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	switch sqliteErr.Code {
+	case sqlite3.ErrNotADB, sqlite3.ErrCantOpen, sqlite3.ErrIoErr:
+		return true
+	}
+	return sqliteErr.ExtendedCode == sqlite3.ErrReadonlyDbMoved
+}
+
+// reconnect replaces conn with a new connection pool if Config.Reconnect
+// is set and err means that conn is broken. It reports whether the failed
+// operation should be run again.
+func (db *DB) reconnect(conn *sql.DB, err error) bool {
+	if !db.config.Reconnect || !isBroken(err) || isMemory(db.filename) || db.closed.Load() {
+		return false
+	}
+
+	db.reopenMu.Lock()
+	defer db.reopenMu.Unlock()
+	// Another operation that failed at the same time may have reconnected already
+	if db.conn.Load() != conn {
+		return true
+	}
+
+	newConn, openErr := openConnection(db.filename, db.config)
+	if openErr == nil {
+		openErr = newConn.Ping()
+		if openErr != nil {
+			newConn.Close()
+		}
+	}
+	if openErr != nil {
+		logf("reconnecting to %s: %v", db.filename, openErr)
+		return false
+	}
+
+	logf("reconnected to %s after: %v", db.filename, err)
+	db.conn.Store(newConn)
+	db.cache.close()
+	conn.Close()
+	return true
+}
@@ -0,0 +1,209 @@
+package sqlite06
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// migrations brings a database from any earlier schema version to the
+// current one. Steps are applied in order and are never edited once released,
+// a schema change always means appending a new step.
+//
+// Databases created by InitDB before versioning was introduced already have
+// some of the later columns, so the steps check before they add anything.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create Users and Userdata tables",
+		apply: execStatements(
+			`CREATE TABLE IF NOT EXISTS Users (
+				ID INTEGER PRIMARY KEY,
+				Username TEXT
+			)`,
+			`CREATE TABLE IF NOT EXISTS Userdata (
+				UserID INTEGER NOT NULL,
+				Name TEXT,
+				Surname TEXT,
+				Description TEXT
+			)`,
+		),
+	},
+	{
+		version:     2,
+		description: "enforce unique usernames",
+		// Makes username uniqueness a guarantee of the database, instead of only
+		// relying on the exists() check which races with concurrent inserts.
+		// Fails if the Users table already holds duplicate usernames.
+		apply: execStatements(
+			`CREATE UNIQUE INDEX IF NOT EXISTS UsersUsername ON Users (Username)`,
+		),
+	},
+	{
+		version:     3,
+		description: "add CreatedAt and UpdatedAt to Userdata",
+		apply: addColumns("Userdata",
+			column{"CreatedAt", "INTEGER"},
+			column{"UpdatedAt", "INTEGER"},
+		),
+	},
+	{
+		version:     4,
+		description: "add Email to Userdata",
+		apply:       addColumns("Userdata", column{"Email", "TEXT"}),
+	},
+	{
+		version:     5,
+		description: "reference Users from Userdata with a foreign key",
+		// SQLite cannot add a constraint to an existing table, so Userdata is
+		// rebuilt. Orphaned rows would violate the new constraint and are dropped.
+		apply: rebuildUserdata(`UserID INTEGER NOT NULL REFERENCES Users (ID)`),
+	},
+	{
+		version:     6,
+		description: "delete Userdata rows together with their Users row",
+		apply:       rebuildUserdata(`UserID INTEGER NOT NULL REFERENCES Users (ID) ON DELETE CASCADE`),
+	},
+	{
+		version:     7,
+		description: "add DeletedAt to Users for soft deletes",
+		apply:       addColumns("Users", column{"DeletedAt", "INTEGER"}),
+	},
+	{
+		version:     8,
+		description: "index the Userdata columns that are queried",
+		// The collations match the ones of the queries, otherwise SQLite
+		// does not use the index. Name is only searched with LIKE '%...%',
+		// which no index can serve, so it gets none.
+		apply: execStatements(
+			`CREATE INDEX IF NOT EXISTS UserdataUserID ON Userdata (UserID)`,
+			`CREATE INDEX IF NOT EXISTS UserdataSurname ON Userdata (Surname COLLATE NOCASE)`,
+			`CREATE INDEX IF NOT EXISTS UserdataEmail ON Userdata (Email COLLATE NOCASE)`,
+		),
+	},
+	{
+		version:     9,
+		description: "enforce case-insensitive unique usernames",
+		// Makes the database reject usernames that differ only in case, also
+		// when they are written by code that skips normalizeUsername.
+		// UsersUsername stays, the lookups compare with BINARY and only use it.
+		// Fails if the Users table already holds usernames that differ only in case.
+		// NOCASE folds ASCII letters only. Databases migrated with
+		// Config.CaseSensitiveUsernames do not get the index.
+		apply: func(ctx context.Context, db *DB, tx *sql.Tx) error {
+			if db.config.CaseSensitiveUsernames {
+				return nil
+			}
+			return execStatements(
+				`CREATE UNIQUE INDEX IF NOT EXISTS UsersUsernameNoCase ON Users (Username COLLATE NOCASE)`,
+			)(ctx, db, tx)
+		},
+	},
+	{
+		version:     10,
+		description: "add PasswordHash to Users",
+		apply:       addColumns("Users", column{"PasswordHash", "TEXT"}),
+	},
+}
+
+// InitDB creates the Users and Userdata tables if they do not exist
+// and upgrades databases created by older versions of this package.
+// It is the same as Migrate.
+// Calling it on a database that is up to date is a no-op
+func (db *DB) InitDB() error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.InitDBContext(ctx)
+}
+
+// InitDBContext is like InitDB but uses ctx for the database calls
+func (db *DB) InitDBContext(ctx context.Context) (err error) {
+	defer observe("InitDB", time.Now(), &err)
+	return db.MigrateContext(ctx)
+}
+
+// execStatements returns a migration step that runs statements in order
+func execStatements(statements ...string) func(context.Context, *DB, *sql.Tx) error {
+	return func(ctx context.Context, db *DB, tx *sql.Tx) error {
+		for _, statement := range statements {
+			_, err := tx.ExecContext(ctx, db.sql(statement))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// rebuildUserdata returns a migration step that recreates the Userdata table
+// with userID as the definition of its UserID column, keeping all the rows
+// that belong to an existing user
+func rebuildUserdata(userID string) func(context.Context, *DB, *sql.Tx) error {
+	return execStatements(
+		`CREATE TABLE Userdata_new (
+			`+userID+`,
+			Name TEXT,
+			Surname TEXT,
+			Description TEXT,
+			Email TEXT,
+			CreatedAt INTEGER,
+			UpdatedAt INTEGER
+		)`,
+		`INSERT INTO Userdata_new (UserID, Name, Surname, Description, Email, CreatedAt, UpdatedAt)
+			SELECT UserID, Name, Surname, Description, Email, CreatedAt, UpdatedAt
+			FROM Userdata WHERE UserID IN (SELECT ID FROM Users)`,
+		`DROP TABLE Userdata`,
+		`ALTER TABLE Userdata_new RENAME TO Userdata`,
+	)
+}
+
+// column is a column name together with its definition
+type column struct {
+	name       string
+	definition string
+}
+
+// addColumns returns a migration step that adds the columns missing from table
+func addColumns(table string, columns ...column) func(context.Context, *DB, *sql.Tx) error {
+	return func(ctx context.Context, db *DB, tx *sql.Tx) error {
+		existing, err := db.tableColumns(ctx, tx, table)
+		if err != nil {
+			return err
+		}
+		for _, c := range columns {
+			if slices.Contains(existing, c.name) {
+				continue
+			}
+			statement := fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, c.name, c.definition)
+			_, err = tx.ExecContext(ctx, db.sql(statement))
+			if err != nil {
+				return fmt.Errorf("adding column %s: %w", c.name, err)
+			}
+		}
+		return nil
+	}
+}
+
+// tableColumns returns the column names of table
+func (db *DB) tableColumns(ctx context.Context, tx *sql.Tx, table string) ([]string, error) {
+	// PRAGMA does not accept parameters, table is never user input
+	// and a configured name has been checked to be an identifier
+	rows, err := tx.QueryContext(ctx, db.sql(`SELECT name FROM pragma_table_info('`+table+`')`))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
@@ -0,0 +1,44 @@
+package sqlite06
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// SeedTestUsers adds n users with predictable data, meant for tests and benchmarks
+// User i gets the username "user<i>", the name "Name<i>" and the surname "Surname<i>",
+// for i from 0 to n-1. All of them are added in one transaction,
+// which fails with ErrUserExists if one of the usernames is taken.
+// Returns the IDs of the new users in order
+func (db *DB) SeedTestUsers(n int) ([]int, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.SeedTestUsersContext(ctx, n)
+}
+
+// SeedTestUsersContext is like SeedTestUsers but uses ctx for the database calls
+func (db *DB) SeedTestUsersContext(ctx context.Context, n int) (_ []int, err error) {
+	defer observe("SeedTestUsers", time.Now(), &err)
+	var ids []int
+	queries := []string{selectUserID, insertUsers, insertUserdata}
+	err = db.withTx(ctx, queries, func(tx *Tx) error {
+		ids = make([]int, 0, n)
+		for i := range n {
+			id, err := tx.AddUser(Userdata{
+				Username: fmt.Sprintf("user%d", i),
+				Name:     fmt.Sprintf("Name%d", i),
+				Surname:  fmt.Sprintf("Surname%d", i),
+			})
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -0,0 +1,71 @@
+package sqlite06
+
+import (
+	"context"
+	"time"
+)
+
+// SoftDelete marks the user with the given ID as deleted without removing
+// any rows. The user disappears from ListUsers and the other listings,
+// but it can still be looked up by ID and brought back with Restore.
+// Soft deleting a user that is already soft deleted keeps the original DeletedAt.
+// Returns ErrUserNotFound if there is no user with that ID
+func (db *DB) SoftDelete(id int) error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.SoftDeleteContext(ctx, id)
+}
+
+// SoftDeleteContext is like SoftDelete but uses ctx for the database calls
+func (db *DB) SoftDeleteContext(ctx context.Context, id int) (err error) {
+	defer observe("SoftDelete", time.Now(), &err)
+	statement := `UPDATE Users SET DeletedAt = COALESCE(DeletedAt, ?) WHERE ID = ?`
+	return db.updateUsersRow(ctx, id, statement, time.Now().Unix(), id)
+}
+
+// Restore undoes SoftDelete for the user with the given ID
+// Returns ErrUserNotFound if there is no user with that ID
+func (db *DB) Restore(id int) error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.RestoreContext(ctx, id)
+}
+
+// RestoreContext is like Restore but uses ctx for the database calls
+func (db *DB) RestoreContext(ctx context.Context, id int) (err error) {
+	defer observe("Restore", time.Now(), &err)
+	statement := `UPDATE Users SET DeletedAt = NULL WHERE ID = ?`
+	return db.updateUsersRow(ctx, id, statement, id)
+}
+
+// updateUsersRow runs statement, which updates the Users row with the given ID,
+// and returns ErrUserNotFound if there is no such row
+func (db *DB) updateUsersRow(ctx context.Context, id int, statement string, args ...any) error {
+	res, err := db.exec(ctx, statement, args...)
+	if err != nil {
+		return err
+	}
+
+	// SQLite counts the rows matched by WHERE, even if no value changed
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return &UserNotFoundError{ID: id}
+	}
+	return nil
+}
+
+// ListUsersIncludingDeleted is like ListUsers but also returns soft deleted users
+func (db *DB) ListUsersIncludingDeleted() ([]Userdata, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.ListUsersIncludingDeletedContext(ctx)
+}
+
+// ListUsersIncludingDeletedContext is like ListUsersIncludingDeleted but uses ctx for the database calls
+func (db *DB) ListUsersIncludingDeletedContext(ctx context.Context) (_ []Userdata, err error) {
+	defer observe("ListUsersIncludingDeleted", time.Now(), &err)
+	return db.queryUsers(ctx, selectUsers+` ORDER BY Users.ID`)
+}
@@ -9,17 +9,76 @@
 package sqlite06
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
+// Sentinel errors returned by the exported functions of this package.
+// Callers should compare against them with errors.Is, since most of them
+// are returned wrapped together with the underlying sql error.
+// The lookups of a single user, like GetUserByID, wrap sql.ErrNoRows
+// together with ErrUserNotFound, so errors.Is holds for both of them.
+// ErrUserExists and ErrUserNotFound come as *UserExistsError and
+// *UserNotFoundError, which carry the username or ID they are about.
 var (
-	Filename = ""
+	ErrUserExists      = errors.New("user already exists")
+	ErrConnection      = errors.New("database connection could not be established")
+	ErrInsert          = errors.New("user could not be inserted")
+	ErrUserNotFound    = errors.New("user not found")
+	ErrInvalidLimit    = errors.New("limit has to be positive")
+	ErrInvalidField    = errors.New("field cannot be updated")
+	ErrInvalidEmail    = errors.New("invalid email address")
+	ErrInvalidUsername = errors.New("invalid username")
+	// ErrInvalidDescription is returned for a Description longer than
+	// Config.MaxDescriptionLength, and by UpdateUserFields for one that is
+	// not a string
+	ErrInvalidDescription = errors.New("invalid description")
+	// ErrInvalidTableName is returned by NewWithConfig for a table name of Config
+	// that is not a plain SQL identifier
+	ErrInvalidTableName = errors.New("invalid table name")
+	// ErrClosed is returned by every operation on a DB after Close
+	ErrClosed = errors.New("database is closed")
+	// ErrIDMismatch is returned by UpdateUser when the ID it was given
+	// belongs to a different user than the username
+	ErrIDMismatch = errors.New("ID does not match username")
+	// ErrNoFilename is returned, wrapped in ErrConnection, when the database
+	// is opened with an empty filename, for instance because Filename was never set
+	ErrNoFilename = errors.New("database filename not configured")
+	// ErrReadOnly is returned by the writes to a DB opened with Config.ReadOnly
+	ErrReadOnly = errors.New("database opened read-only")
+	// ErrInvalidName is returned by UpdateName for an empty or too long
+	// Name or Surname, the message says which one
+	ErrInvalidName = errors.New("invalid name")
+	// ErrInvalidPassword is returned for a password that cannot be stored,
+	// because it is empty or longer than the 72 bytes bcrypt accepts
+	ErrInvalidPassword = errors.New("invalid password")
+	// ErrNotDatabase is returned by DatabaseFileExists for a file that is not
+	// a SQLite database
+	ErrNotDatabase = errors.New("file is not a SQLite database")
 )
 
+// isUniqueViolation reports whether err was caused by a UNIQUE constraint
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	return false
+}
+
 // Most of the time, you need as many structures as there are database tables
 type Userdata struct {
 	ID          int
@@ -27,213 +86,1647 @@ type Userdata struct {
 	Name        string
 	Surname     string
 	Description string
+	Email       string
+	// CreatedAt and UpdatedAt are stored as unix timestamps, so they
+	// have a precision of one second. They are zero for users without a Userdata row.
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// DeletedAt is set when the user has been soft deleted with SoftDelete
+	DeletedAt time.Time
+	// Password is optional and only read by the functions that add users,
+	// which store its bcrypt hash, see SetPassword and VerifyPassword.
+	// The lookups leave it empty and it is never encoded to JSON.
+	Password string `json:"-"`
 }
 
-// This function is private and only accessed within the scope of this package (starts with lowercase letter)
-func openConnection() (*sql.DB, error) {
-	// Before calling this func, programmer has to set `Filename` variable using:
-	// sqlite06.Filename = "ch06.db" for instance.
-	// SQLite3 does not require a username or a password and does not operate over a TCP/IP network.
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanUser reads the columns selected by selectUsers, in that order,
+// into a Userdata value.
+// The Userdata columns may be NULL when the user has no Userdata row.
+func scanUser(row rowScanner) (Userdata, error) {
+	var id int
+	var username string
+	var name sql.NullString
+	var surname sql.NullString
+	var description sql.NullString
+	var email sql.NullString
+	var createdAt sql.NullInt64
+	var updatedAt sql.NullInt64
+	var deletedAt sql.NullInt64
+
+	err := row.Scan(&id, &username, &name, &surname, &description, &email, &createdAt, &updatedAt, &deletedAt)
+	if err != nil {
+		return Userdata{}, err
+	}
+	return Userdata{ID: id, Username: username, Name: name.String, Surname: surname.String, Description: description.String,
+		Email: email.String, CreatedAt: unixTime(createdAt), UpdatedAt: unixTime(updatedAt), DeletedAt: unixTime(deletedAt)}, nil
+}
+
+// unixTime converts a nullable unix timestamp column to a time.Time,
+// NULL becomes the zero time.Time
+func unixTime(t sql.NullInt64) time.Time {
+	if !t.Valid {
+		return time.Time{}
+	}
+	return time.Unix(t.Int64, 0)
+}
+
+// DB is a handle to a single SQLite database file.
+// It keeps one *sql.DB open for its whole lifetime, which is a connection
+// pool by itself and is safe for concurrent use.
+// All the methods of DB can be called from many goroutines at once, except
+// Close and Rename, which have to wait until the other calls are done.
+// Concurrent writes wait for each other, see Config.BusyTimeout and Config.MaxRetries.
+// Use New to create one and Close to release it; the zero value is not usable.
+type DB struct {
+	filename string
+	config   Config
+	tables   *strings.Replacer
+	cache    stmtCache
+	closed   atomic.Bool
 
-	db, err := sql.Open("sqlite3", Filename)
+	// conn is only replaced by Rename and by a reconnect, see Config.Reconnect
+	conn     atomic.Pointer[sql.DB]
+	reopenMu sync.Mutex
+	// external is set when conn belongs to the caller, see NewWithDB
+	external bool
+}
+
+// New opens the SQLite database stored in filename with the default Config
+// The returned DB should be closed with Close when it is no longer needed
+func New(filename string) (*DB, error) {
+	return NewWithConfig(filename, Config{})
+}
+
+// NewWithConfig is like New but applies the settings in config
+func NewWithConfig(filename string, config Config) (*DB, error) {
+	tables, err := config.tableNames()
 	if err != nil {
-		fmt.Println("Database connection could not be established in func openConnection().")
 		return nil, err
 	}
+
+	conn, err := openConnection(filename, config)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrConnection, err)
+	}
+
+	// sql.Open() does not touch the file, Ping() makes sure that it can be used.
+	err = ping(conn, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %w", ErrConnection, err)
+	}
+	db := &DB{filename: filename, config: config, tables: tables}
+	db.conn.Store(conn)
 	return db, nil
 }
 
-// This function is also private
-// Returns the ID of a user whose username is provided in as input parameter
-// Returns -1 if there's an error, or user is not found
-func exists(username string) int {
-	username = strings.ToLower(username)
-	// As said above, we can use openConnection() function within the scope of this package
-	db, err := openConnection()
+// NewWithDB returns a DB that uses conn, a pool opened and owned by the caller,
+// instead of opening its own. Close does not close conn.
+// conn has to enforce foreign keys, with "_foreign_keys=on" in the DSN of
+// go-sqlite3, otherwise deleting a user leaves its Userdata row behind.
+// It should also set "_txlock=immediate", or concurrent writes fail with SQLITE_BUSY.
+// Rename is not supported and Stats reports no FileSize.
+func NewWithDB(conn *sql.DB) *DB {
+	db := &DB{external: true}
+	db.conn.Store(conn)
+	return db
+}
+
+// NewInMemory returns a DB backed by a private in-memory database
+// with the tables already created. It is meant for tests: the data is lost
+// on Close, and all the operations share a single connection.
+func NewInMemory() (*DB, error) {
+	db, err := New(":memory:")
 	if err != nil {
-		fmt.Println("Database connection could not be established in func exists().")
-		fmt.Println(err)
-		return -1
+		return nil, err
 	}
-	defer db.Close()
-
-	// This one is prone to sql injection attacks
-	// statement := fmt.Sprintf(`SELECT ID FROM Users where Username = '%s'`, username)
 
-	statement := "SELECT ID FROM Users WHERE Username = ?"
-	rows, err := db.Query(statement, username)
+	err = db.InitDB()
 	if err != nil {
-		fmt.Println("Error retrieving username:", err)
-		return -1
+		db.Close()
+		return nil, err
 	}
-	defer rows.Close()
+	return db, nil
+}
 
-	userID := -1
-	for rows.Next() {
-		var id int
-		err = rows.Scan(&id)
-		if err != nil {
-			fmt.Println("exists() Scan", err)
-			return -1
-		}
-		userID = id
+// Close releases the underlying database connections and the prepared statements
+// The connections of NewWithDB are left to the caller.
+// Every later call on db, Close included, returns ErrClosed.
+func (db *DB) Close() error {
+	if !db.closed.CompareAndSwap(false, true) {
+		return ErrClosed
 	}
-	return userID
+	if db.external {
+		return db.cache.close()
+	}
+	return errors.Join(db.cache.close(), db.conn.Load().Close())
 }
 
-// AddUser adds a new user to the database
-// Returns new User ID
-// -1 if there was an error
-func AddUser(d Userdata) int {
-	d.Username = strings.ToLower(d.Username)
+// DB returns the underlying *sql.DB, for running statements this package
+// does not provide on the same connection pool
+// It must not be closed, Close takes care of that, and it is replaced by Rename.
+// For in-memory databases the pool has a single connection, which stays busy
+// while a transaction of the package or the rows of a query are open.
+// The tables are named as in the Config of db.
+func (db *DB) DB() *sql.DB {
+	return db.conn.Load()
+}
 
-	db, err := openConnection()
-	if err != nil {
-		fmt.Println("Database connection could not be established in func AddUser().")
-		fmt.Println(err)
-		return -1
+// The methods below are the only way the operations reach db.conn,
+// they rewrite the table names of query and fail with ErrClosed after Close.
+
+// exec runs query, which returns no rows
+// It is retried while the database is busy, see Config.MaxRetries
+func (db *DB) exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	if db.closed.Load() {
+		return nil, ErrClosed
+	}
+	var res sql.Result
+	err := db.retry(ctx, func() error {
+		var err error
+		res, err = db.conn.Load().ExecContext(ctx, db.sql(query), args...)
+		return err
+	})
+	return res, err
+}
+
+// query runs query, which returns rows
+func (db *DB) query(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	if db.closed.Load() {
+		return nil, ErrClosed
 	}
-	defer db.Close()
-	userID := exists(d.Username)
-	if userID != -1 {
-		fmt.Println("User already exists:", d.Username)
-		return -1
+	conn := db.conn.Load()
+	rows, err := conn.QueryContext(ctx, db.sql(query), args...)
+	if db.reconnect(conn, err) {
+		rows, err = db.conn.Load().QueryContext(ctx, db.sql(query), args...)
 	}
+	return rows, err
+}
 
-	insertStatement := `INSERT INTO Users values (NULL,?)`
+// queryRow runs query, which returns at most one row
+func (db *DB) queryRow(ctx context.Context, query string, args ...any) rowScanner {
+	if db.closed.Load() {
+		return errRow{ErrClosed}
+	}
+	return reconnectRow{db: db, ctx: ctx, query: query, args: args}
+}
 
-	_, err = db.Exec(insertStatement, d.Username)
-	if err != nil {
-		fmt.Println(err)
-		return -1
+// reconnectRow runs its query when it is scanned, so that the query can be
+// run once more after a reconnect
+type reconnectRow struct {
+	db    *DB
+	ctx   context.Context
+	query string
+	args  []any
+}
+
+func (r reconnectRow) Scan(dest ...any) error {
+	conn := r.db.conn.Load()
+	err := conn.QueryRowContext(r.ctx, r.db.sql(r.query), r.args...).Scan(dest...)
+	if r.db.reconnect(conn, err) {
+		err = r.db.conn.Load().QueryRowContext(r.ctx, r.db.sql(r.query), r.args...).Scan(dest...)
 	}
+	return err
+}
+
+// errRow is a row whose Scan fails with err
+type errRow struct {
+	err error
+}
 
-	userID = exists(d.Username)
+func (r errRow) Scan(dest ...any) error {
+	return r.err
+}
 
-	// `userID` field of Userdata table is the same value from Users table `ID` field
-	insertStatement = `INSERT INTO Userdata values (?,?,?,?)`
-	_, err = db.Exec(insertStatement, userID, d.Name, d.Surname, d.Description)
+// begin starts a transaction
+func (db *DB) begin(ctx context.Context) (*sql.Tx, error) {
+	if db.closed.Load() {
+		return nil, ErrClosed
+	}
+	return db.conn.Load().BeginTx(ctx, nil)
+}
 
-	if err != nil {
-		fmt.Println(err)
-		return -1
+// readTx runs fn in a deferred transaction on a connection of its own
+// Unlike the transactions of begin, which take the write lock at once, it only
+// takes a read lock, so it neither waits for writers nor blocks them.
+func (db *DB) readTx(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	if db.closed.Load() {
+		return ErrClosed
 	}
-	return userID
+	pool := db.conn.Load()
+	err := runReadTx(ctx, pool, fn)
+	if db.reconnect(pool, err) {
+		err = runReadTx(ctx, db.conn.Load(), fn)
+	}
+	return err
 }
 
-func DeleteUser(id int) error {
-	db, err := openConnection()
+// runReadTx does a single attempt of readTx on a connection of pool
+func runReadTx(ctx context.Context, pool *sql.DB, fn func(conn *sql.Conn) error) (err error) {
+	conn, err := pool.Conn(ctx)
 	if err != nil {
-		fmt.Println("Database connection could not be established in func DeleteUser().")
 		return err
 	}
-	defer db.Close()
+	defer conn.Close()
 
-	// Check ID existance
-	statement := `SELECT Username FROM Users WHERE ID = ?`
-	rows, err := db.Query(statement, id)
+	_, err = conn.ExecContext(ctx, `BEGIN`)
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		// The connection goes back to the pool, so the transaction has to end
+		// even when ctx is done. If it cannot, the connection is discarded.
+		_, rollbackErr := conn.ExecContext(context.WithoutCancel(ctx), `ROLLBACK`)
+		if rollbackErr != nil {
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+	}()
 
+	err = fn(conn)
 	if err != nil {
 		return err
 	}
+	_, err = conn.ExecContext(ctx, `COMMIT`)
+	committed = err == nil
+	return err
+}
+
+// LEFT JOIN keeps users that have no matching Userdata row,
+// their Name, Surname, Description and Email come back as empty strings.
+const selectUsers = `SELECT ID, Username, Name, Surname, Description, Email, CreatedAt, UpdatedAt, DeletedAt
+              FROM Users LEFT JOIN Userdata ON Users.ID = Userdata.UserID`
+
+// notDeleted is the condition that hides soft deleted users from listings
+const notDeleted = `Users.DeletedAt IS NULL`
+
+// queryUsers runs statement, which has to select the same columns as
+// selectUsers, and returns all the resulting users.
+// The returned slice is never nil when err is nil.
+func (db *DB) queryUsers(ctx context.Context, statement string, args ...any) ([]Userdata, error) {
+	Data := []Userdata{}
+	err := db.eachUser(ctx, func(temp Userdata) error {
+		Data = append(Data, temp)
+		return nil
+	}, statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	return Data, nil
+}
 
+// eachUser runs statement, which has to select the same columns as
+// selectUsers, and calls fn for every resulting user as soon as it is read.
+// It stops at the first error returned by fn and returns it.
+func (db *DB) eachUser(ctx context.Context, fn func(Userdata) error, statement string, args ...any) error {
+	rows, err := db.query(ctx, statement, args...)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
 
-	var username string
 	for rows.Next() {
-		err = rows.Scan(&username)
+		temp, err := scanUser(rows)
+		if err != nil {
+			return err
+		}
+		err = fn(temp)
 		if err != nil {
 			return err
 		}
 	}
+	return rows.Err()
+}
 
-	if exists(username) == -1 {
-		return fmt.Errorf("user with ID %d does not exist", id)
+// sqliteHeader is how every SQLite database file starts
+const sqliteHeader = "SQLite format 3\x00"
+
+// DatabaseFileExists reports whether filename is an existing SQLite database,
+// without creating it like New does. It is false for a file that does not
+// exist yet, for an empty file, which SQLite initializes on first write,
+// and for an in-memory database. filename can also be a file: URI.
+// Returns ErrNotDatabase if the file has some other content
+func DatabaseFileExists(filename string) (bool, error) {
+	if strings.TrimSpace(filename) == "" {
+		return false, ErrNoFilename
+	}
+	if isMemory(filename) {
+		return false, nil
 	}
 
-	// At this point, we are sure that userID exists in both tables
-	deleteStatement := `DELETE FROM Userdata WHERE UserID = ?`
-	_, err = db.Exec(deleteStatement, id)
+	f, err := os.Open(filePath(filename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
 	if err != nil {
-		return err
+		return false, err
+	}
+	defer f.Close()
+
+	header := make([]byte, len(sqliteHeader))
+	_, err = io.ReadFull(f, header)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	if err != nil || string(header) != sqliteHeader {
+		return false, fmt.Errorf("%w: %s", ErrNotDatabase, filename)
+	}
+	return true, nil
+}
+
+// This function is private and only accessed within the scope of this package (starts with lowercase letter)
+func openConnection(filename string, config Config) (*sql.DB, error) {
+	// SQLite would quietly open a temporary database for an empty filename,
+	// which loses all the data on close. Use ":memory:" to get that on purpose.
+	if strings.TrimSpace(filename) == "" {
+		return nil, ErrNoFilename
+	}
+	// SQLite3 does not require a username or a password and does not operate over a TCP/IP network.
+	conn, err := sql.Open("sqlite3", config.dsn(filename))
+	if err != nil {
+		return nil, err
+	}
+
+	// Every connection to ":memory:" gets its own, empty database, so the
+	// pool is limited to a single connection that is never closed.
+	// This is why code holding a transaction must only use the *sql.Tx,
+	// asking db.conn for a second connection would block forever.
+	if isMemory(filename) {
+		conn.SetMaxOpenConns(1)
+		conn.SetMaxIdleConns(1)
+		conn.SetConnMaxLifetime(0)
+		conn.SetConnMaxIdleTime(0)
+		return conn, nil
+	}
+	if config.MaxOpenConns > 0 {
+		conn.SetMaxOpenConns(config.MaxOpenConns)
+	}
+	if config.MaxIdleConns > 0 {
+		conn.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	return conn, nil
+}
+
+// This function is also private
+// Returns the ID of a user whose username is provided in as input parameter
+// Returns -1 and a nil error if the user is not found, so that callers can
+// tell a missing user apart from a failing query
+func (db *DB) exists(ctx context.Context, username string) (int, error) {
+	username = db.normalizeUsername(username)
+
+	// This one is prone to sql injection attacks
+	// statement := fmt.Sprintf(`SELECT ID FROM Users where Username = '%s'`, username)
+
+	// The cached statement bypasses queryRow, so it reconnects by itself
+	conn := db.conn.Load()
+	userID, err := db.lookupUserID(ctx, username)
+	if db.reconnect(conn, err) {
+		userID, err = db.lookupUserID(ctx, username)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return -1, nil
+	}
+	if err != nil {
+		logf("exists(): %v", err)
+		return -1, fmt.Errorf("looking up user %s: %w", username, err)
+	}
+	return userID, nil
+}
+
+// lookupUserID runs selectUserID through the statement cache
+func (db *DB) lookupUserID(ctx context.Context, username string) (int, error) {
+	stmt, err := db.stmt(ctx, selectUserID)
+	if err != nil {
+		return -1, err
+	}
+	var userID int
+	err = stmt.QueryRowContext(ctx, username).Scan(&userID)
+	return userID, err
+}
+
+// UserExists reports whether a user with the given username exists
+func (db *DB) UserExists(username string) (bool, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.UserExistsContext(ctx, username)
+}
+
+// UserExistsContext is like UserExists but uses ctx for the database calls
+func (db *DB) UserExistsContext(ctx context.Context, username string) (_ bool, err error) {
+	defer observe("UserExists", time.Now(), &err)
+	userID, err := db.exists(ctx, username)
+	if err != nil {
+		return false, err
 	}
+	return userID != -1, nil
+}
+
+// insertUserdata inserts a Userdata row, its parameters are
+// UserID, Name, Surname, Description, Email, CreatedAt and UpdatedAt
+const insertUserdata = `INSERT INTO Userdata (UserID, Name, Surname, Description, Email, CreatedAt, UpdatedAt)
+              VALUES (?,?,?,?,?,?,?)`
 
-	deleteStatement = `DELETE FROM Users WHERE ID = ?`
+// AddUser adds a new user to the database
+// Returns new User ID and a nil error on success
+// Returns ErrUserExists if the username is already taken
+// and ErrInvalidUsername if it is empty
+func (db *DB) AddUser(d Userdata) (int, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.AddUserContext(ctx, d)
+}
 
-	_, err = db.Exec(deleteStatement, id)
+// AddUserContext is like AddUser but uses ctx for the database calls
+func (db *DB) AddUserContext(ctx context.Context, d Userdata) (_ int, err error) {
+	defer observe("AddUser", time.Now(), &err)
+	hash, err := hashPassword(d.Password)
 	if err != nil {
+		return -1, err
+	}
+
+	// Both inserts happen in one transaction, so that a failure of the second
+	// one does not leave a Users row without its Userdata row behind.
+	userID := -1
+	queries := []string{selectUserID, insertUsers, insertUserdata}
+	err = db.withTx(ctx, queries, func(tx *Tx) error {
+		var err error
+		userID, err = tx.addUser(d, hash)
 		return err
+	})
+	if err != nil {
+		return -1, err
 	}
-	return nil
+	return userID, nil
 }
 
-func ListUsers() ([]Userdata, error) {
-	Data := []Userdata{}
-	db, err := openConnection()
+// CreateUser is like AddUser but returns the user as it has been stored,
+// with its ID, normalized username and timestamps filled in
+func (db *DB) CreateUser(d Userdata) (Userdata, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.CreateUserContext(ctx, d)
+}
+
+// CreateUserContext is like CreateUser but uses ctx for the database calls
+func (db *DB) CreateUserContext(ctx context.Context, d Userdata) (_ Userdata, err error) {
+	defer observe("CreateUser", time.Now(), &err)
+	hash, err := hashPassword(d.Password)
 	if err != nil {
-		fmt.Println("Database connection could not be established in func ListUsers().")
-		return nil, err
+		return Userdata{}, err
 	}
-	defer db.Close()
 
-	// statement := `SELECT ID, Username, Name, Surname, Description
-	// 	FROM USERS, Userdata WHERE Users.ID = Userdata.UserID`
+	var user Userdata
+	queries := []string{selectUserID, insertUsers, insertUserdata}
+	err = db.withTx(ctx, queries, func(tx *Tx) error {
+		userID, err := tx.addUser(d, hash)
+		if err != nil {
+			return err
+		}
+		// Read back within the transaction, so that it is the row just written
+		user, err = scanUser(tx.queryRow(selectUsers+` WHERE Users.ID = ?`, userID))
+		return err
+	})
+	if err != nil {
+		return Userdata{}, err
+	}
+	return user, nil
+}
 
-	statement := `SELECT ID, Username, Name, Surname, Description
-              FROM Users INNER JOIN Userdata ON Users.ID = Userdata.UserID`
+// AddUsers adds all the given users to the database in a single transaction
+// Returns the new User IDs in the same order as users
+// Users whose username already exists are skipped and get -1 as their ID,
+// any other error rolls back the whole batch.
+func (db *DB) AddUsers(users []Userdata) ([]int, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.AddUsersContext(ctx, users)
+}
 
-	rows, err := db.Query(statement)
+// AddUsersContext is like AddUsers but uses ctx for the database calls
+func (db *DB) AddUsersContext(ctx context.Context, users []Userdata) (_ []int, err error) {
+	defer observe("AddUsers", time.Now(), &err)
+	hashes, err := hashPasswords(users)
+	if err != nil {
+		return nil, err
+	}
 
+	var ids []int
+	err = db.retry(ctx, func() error {
+		var err error
+		ids, err = db.addUsers(ctx, users, hashes)
+		return err
+	})
 	if err != nil {
-		return Data, err
+		return nil, err
 	}
+	return ids, nil
+}
 
-	defer rows.Close()
+// addUsers does a single attempt of AddUsers, hashes are the hashed
+// passwords of users
+func (db *DB) addUsers(ctx context.Context, users []Userdata, hashes []sql.NullString) ([]int, error) {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInsert, err)
+	}
+	defer tx.Rollback()
 
-	for rows.Next() {
-		var id int
-		var username string
-		var name string
-		var surname string
-		var description string
+	inserter, err := db.newBatchInserter(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	defer inserter.close()
 
-		err = rows.Scan(&id, &username, &name, &surname, &description)
+	ids := make([]int, 0, len(users))
+	for i, d := range users {
+		id, err := inserter.insert(ctx, d, hashes[i])
+		if errors.Is(err, ErrUserExists) {
+			ids = append(ids, -1)
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
+		ids = append(ids, id)
+	}
 
-		temp := Userdata{ID: id, Username: username, Name: name, Surname: surname, Description: description}
-		Data = append(Data, temp)
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInsert, err)
 	}
-	return Data, nil
+	return ids, nil
 }
 
-// UpdateUser is for updating an existing user
-func UpdateUser(d Userdata) error {
-	db, err := openConnection()
+// batchInserter adds many users within one transaction,
+// preparing its statements once and reusing them for every user
+type batchInserter struct {
+	db           *DB
+	existsStmt   *sql.Stmt
+	usersStmt    *sql.Stmt
+	userdataStmt *sql.Stmt
+}
 
+// newBatchInserter prepares the statements of a batchInserter within tx
+func (db *DB) newBatchInserter(ctx context.Context, tx *sql.Tx) (*batchInserter, error) {
+	b := &batchInserter{db: db}
+
+	var err error
+	b.existsStmt, err = tx.PrepareContext(ctx, db.sql(selectUserID))
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%w: %w", ErrInsert, err)
+	}
+	b.usersStmt, err = tx.PrepareContext(ctx, db.sql(insertUsers))
+	if err != nil {
+		b.close()
+		return nil, fmt.Errorf("%w: %w", ErrInsert, err)
+	}
+	b.userdataStmt, err = tx.PrepareContext(ctx, db.sql(insertUserdata))
+	if err != nil {
+		b.close()
+		return nil, fmt.Errorf("%w: %w", ErrInsert, err)
+	}
+	return b, nil
+}
+
+// insert adds d, with hash as the hash of its password, and returns its new ID
+// Returns ErrUserExists if the username is already taken
+func (b *batchInserter) insert(ctx context.Context, d Userdata, hash sql.NullString) (int, error) {
+	d.Username = b.db.normalizeUsername(d.Username)
+	err := b.db.validate(&d)
+	if err != nil {
+		return -1, err
+	}
+
+	if !b.db.config.SkipExistsCheck {
+		var existing int
+		err = b.existsStmt.QueryRowContext(ctx, d.Username).Scan(&existing)
+		if err == nil {
+			return -1, &UserExistsError{Username: d.Username}
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return -1, fmt.Errorf("%w: %w", ErrInsert, err)
+		}
+	}
+
+	// A failed INSERT only undoes itself, the transaction goes on
+	res, err := b.usersStmt.ExecContext(ctx, d.Username, hash)
+	if isUniqueViolation(err) {
+		return -1, &UserExistsError{Username: d.Username}
+	}
+	if err != nil {
+		return -1, fmt.Errorf("%w: %w", ErrInsert, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return -1, fmt.Errorf("%w: %w", ErrInsert, err)
 	}
-	defer db.Close()
 
-	// Let's check if the user exists first
-	d.Username = strings.ToLower(d.Username)
-	userID := exists(d.Username)
+	now := time.Now().Unix()
+	_, err = b.userdataStmt.ExecContext(ctx, id, d.Name, d.Surname, d.Description, d.Email, now, now)
+	if err != nil {
+		return -1, fmt.Errorf("%w: %w", ErrInsert, err)
+	}
+	return int(id), nil
+}
 
-	if userID == -1 {
-		return fmt.Errorf("the user %s does not exist", d.Username)
+// close closes the prepared statements of b
+func (b *batchInserter) close() {
+	for _, stmt := range []*sql.Stmt{b.existsStmt, b.usersStmt, b.userdataStmt} {
+		if stmt != nil {
+			stmt.Close()
+		}
 	}
+}
+
+// DeleteUser deletes the user with the given ID from both tables
+// Both deletes happen in one transaction, so either both rows are gone or none
+// Returns ErrUserNotFound if there is no user with that ID
+func (db *DB) DeleteUser(id int) error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.DeleteUserContext(ctx, id)
+}
+
+// DeleteUserContext is like DeleteUser but uses ctx for the database calls
+func (db *DB) DeleteUserContext(ctx context.Context, id int) (err error) {
+	defer observe("DeleteUser", time.Now(), &err)
+	return db.withTx(ctx, nil, func(tx *Tx) error {
+		return tx.DeleteUser(id)
+	})
+}
 
-	d.ID = userID
+// deleteUserTx deletes the user with the given ID within tx
+// The Userdata row goes away with it through ON DELETE CASCADE, which needs
+// the foreign_keys pragma that openConnection() turns on and a database
+// that has been brought up to date with Migrate.
+// It reports false if no Users row had that ID
+func (db *DB) deleteUserTx(ctx context.Context, tx *sql.Tx, id int) (bool, error) {
+	deleteStatement := `DELETE FROM Users WHERE ID = ?`
+	res, err := tx.ExecContext(ctx, db.sql(deleteStatement), id)
+	if err != nil {
+		return false, err
+	}
 
-	statement := `UPDATE Userdata SET Name = ?, Surname = ?, Description = ? WHERE UserID = ?`
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
 
-	_, err = db.Exec(statement, d.Name, d.Surname, d.Description, d.ID)
+// DeleteUserByUsername deletes the user with the given username from both tables
+// Returns ErrInvalidUsername for an empty username and ErrUserNotFound if there
+// is no such user
+func (db *DB) DeleteUserByUsername(username string) error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.DeleteUserByUsernameContext(ctx, username)
+}
 
+// DeleteUserByUsernameContext is like DeleteUserByUsername but uses ctx for the database calls
+func (db *DB) DeleteUserByUsernameContext(ctx context.Context, username string) (err error) {
+	defer observe("DeleteUserByUsername", time.Now(), &err)
+	username = db.normalizeUsername(username)
+	err = validateUsername(username)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// The ID is resolved inside the transaction, so that it cannot change
+	// between the lookup and the deletes
+	return db.withTx(ctx, nil, func(tx *Tx) error {
+		id, err := tx.userID(username)
+		if err != nil {
+			return err
+		}
+		if id == -1 {
+			return &UserNotFoundError{Username: username}
+		}
+
+		_, err = db.deleteUserTx(ctx, tx.tx, id)
+		return err
+	})
+}
+
+// DeleteAllUsers deletes every user, soft deleted ones included, from both tables
+// This is destructive and cannot be undone, it is meant for resetting
+// test fixtures and for administrative resets.
+// Returns the number of users that were deleted
+func (db *DB) DeleteAllUsers() (int, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.DeleteAllUsersContext(ctx)
+}
+
+// DeleteAllUsersContext is like DeleteAllUsers but uses ctx for the database calls
+func (db *DB) DeleteAllUsersContext(ctx context.Context) (_ int, err error) {
+	defer observe("DeleteAllUsers", time.Now(), &err)
+	var deleted int64
+	err = db.destructiveTx(ctx, func(tx *Tx) error {
+		// Userdata goes first, so that no row is left referencing a deleted user
+		// even on a database that has not been migrated to ON DELETE CASCADE yet
+		_, err := tx.exec(`DELETE FROM Userdata`)
+		if err != nil {
+			return err
+		}
+		res, err := tx.exec(`DELETE FROM Users`)
+		if err != nil {
+			return err
+		}
+		deleted, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted), nil
+}
+
+// DeleteUsers deletes the users with the given IDs from both tables in one transaction
+// IDs without a user are skipped, so the result can be smaller than len(ids).
+// Returns the number of users that were deleted
+func (db *DB) DeleteUsers(ids []int) (int, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.DeleteUsersContext(ctx, ids)
+}
+
+// DeleteUsersContext is like DeleteUsers but uses ctx for the database calls
+func (db *DB) DeleteUsersContext(ctx context.Context, ids []int) (_ int, err error) {
+	defer observe("DeleteUsers", time.Now(), &err)
+	var deleted int64
+	err = db.destructiveTx(ctx, func(tx *Tx) error {
+		deleted = 0
+		for chunk := range slices.Chunk(ids, maxParams) {
+			// The Userdata rows go with ON DELETE CASCADE, as in deleteUserTx()
+			statement := `DELETE FROM Users WHERE ID IN (` + placeholders(len(chunk)) + `)`
+			res, err := tx.exec(statement, intArgs(chunk)...)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			deleted += n
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted), nil
+}
+
+// ListUsers returns all users in the database ordered by ID
+// Soft deleted users are left out, see ListUsersIncludingDeleted
+func (db *DB) ListUsers() ([]Userdata, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.ListUsersContext(ctx)
+}
+
+// ListUsersContext is like ListUsers but uses ctx for the database calls
+func (db *DB) ListUsersContext(ctx context.Context) (_ []Userdata, err error) {
+	defer observe("ListUsers", time.Now(), &err)
+	// statement := `SELECT ID, Username, Name, Surname, Description
+	// 	FROM USERS, Userdata WHERE Users.ID = Userdata.UserID`
+
+	return db.queryUsers(ctx, selectUsers+` WHERE `+notDeleted+` ORDER BY Users.ID`)
+}
+
+// ListUsernames returns the usernames of all users in alphabetical order,
+// leaving out soft deleted users like ListUsers
+// It reads only the Users table, which makes it much cheaper than ListUsers.
+func (db *DB) ListUsernames() ([]string, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.ListUsernamesContext(ctx)
+}
+
+// ListUsernamesContext is like ListUsernames but uses ctx for the database calls
+func (db *DB) ListUsernamesContext(ctx context.Context) (_ []string, err error) {
+	defer observe("ListUsernames", time.Now(), &err)
+	rows, err := db.query(ctx, `SELECT Username FROM Users WHERE `+notDeleted+` ORDER BY Username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usernames := []string{}
+	for rows.Next() {
+		var username string
+		err = rows.Scan(&username)
+		if err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
+}
+
+// ListUsersByUsernameMap returns all users keyed by their normalized username,
+// leaving out soft deleted users like ListUsers
+// The unique indexes on Username keep two users from sharing a key. Only
+// legacy databases that NormalizeExistingUsernames reports conflicts for can
+// have such users, then the one with the highest ID is in the map.
+func (db *DB) ListUsersByUsernameMap() (map[string]Userdata, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.ListUsersByUsernameMapContext(ctx)
+}
+
+// ListUsersByUsernameMapContext is like ListUsersByUsernameMap but uses ctx for the database calls
+func (db *DB) ListUsersByUsernameMapContext(ctx context.Context) (_ map[string]Userdata, err error) {
+	defer observe("ListUsersByUsernameMap", time.Now(), &err)
+	users := map[string]Userdata{}
+	err = db.eachUser(ctx, func(d Userdata) error {
+		users[db.normalizeUsername(d.Username)] = d
+		return nil
+	}, selectUsers+` WHERE `+notDeleted+` ORDER BY Users.ID`)
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// ListUsersFunc calls fn for every user, in the same order as ListUsers,
+// as each one is read from the database, so the users are never all held in memory.
+// It stops at the first error returned by fn and returns it.
+// With an in-memory database fn must not use db, the rows being read hold its only connection.
+func (db *DB) ListUsersFunc(fn func(Userdata) error) error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.ListUsersFuncContext(ctx, fn)
+}
+
+// ListUsersFuncContext is like ListUsersFunc but uses ctx for the database calls
+func (db *DB) ListUsersFuncContext(ctx context.Context, fn func(Userdata) error) (err error) {
+	defer observe("ListUsersFunc", time.Now(), &err)
+	return db.eachUser(ctx, fn, selectUsers+` WHERE `+notDeleted+` ORDER BY Users.ID`)
+}
+
+// MaxPageSize is the largest limit accepted by ListUsersPage,
+// bigger values are capped to it
+const MaxPageSize = 1000
+
+// ListUsersPage returns at most limit users, skipping the first offset ones
+// Users are ordered by ID so that consecutive pages do not overlap
+// limit has to be positive, a negative offset is treated as zero
+func (db *DB) ListUsersPage(limit, offset int) ([]Userdata, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.ListUsersPageContext(ctx, limit, offset)
+}
+
+// ListUsersPageContext is like ListUsersPage but uses ctx for the database calls
+func (db *DB) ListUsersPageContext(ctx context.Context, limit, offset int) (_ []Userdata, err error) {
+	defer observe("ListUsersPage", time.Now(), &err)
+	if limit <= 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidLimit, limit)
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	statement := selectUsers + ` WHERE ` + notDeleted + ` ORDER BY Users.ID LIMIT ? OFFSET ?`
+	return db.queryUsers(ctx, statement, limit, offset)
+}
+
+// ListUsersPaged is like ListUsersPage but also returns the total number of
+// users, as CountUsers does. Both are read in one read transaction, so that
+// they agree even while other connections add or delete users.
+func (db *DB) ListUsersPaged(limit, offset int) (users []Userdata, total int, err error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.ListUsersPagedContext(ctx, limit, offset)
+}
+
+// ListUsersPagedContext is like ListUsersPaged but uses ctx for the database calls
+func (db *DB) ListUsersPagedContext(ctx context.Context, limit, offset int) (users []Userdata, total int, err error) {
+	defer observe("ListUsersPaged", time.Now(), &err)
+	if limit <= 0 {
+		return nil, 0, fmt.Errorf("%w: %d", ErrInvalidLimit, limit)
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	err = db.readTx(ctx, func(conn *sql.Conn) error {
+		err := conn.QueryRowContext(ctx, db.sql(`SELECT COUNT(*) FROM Users WHERE `+notDeleted)).Scan(&total)
+		if err != nil {
+			return err
+		}
+
+		statement := selectUsers + ` WHERE ` + notDeleted + ` ORDER BY Users.ID LIMIT ? OFFSET ?`
+		rows, err := conn.QueryContext(ctx, db.sql(statement), limit, offset)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		users = []Userdata{}
+		for rows.Next() {
+			user, err := scanUser(rows)
+			if err != nil {
+				return err
+			}
+			users = append(users, user)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+// SearchUsers returns the users whose Username, Name or Surname contains query
+// The match is case-insensitive and an empty slice is returned when nothing matches
+// Users are ordered by ID
+func (db *DB) SearchUsers(query string) ([]Userdata, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.SearchUsersContext(ctx, query)
+}
+
+// SearchUsersContext is like SearchUsers but uses ctx for the database calls
+func (db *DB) SearchUsersContext(ctx context.Context, query string) (_ []Userdata, err error) {
+	defer observe("SearchUsers", time.Now(), &err)
+	// % and _ are wildcards for LIKE, so they are escaped in order to be
+	// matched literally. LIKE in SQLite ignores the case of ASCII letters.
+	pattern := "%" + likeEscaper.Replace(query) + "%"
+
+	statement := selectUsers + ` WHERE ` + notDeleted + `
+              AND (Username LIKE ? ESCAPE '\' OR Name LIKE ? ESCAPE '\' OR Surname LIKE ? ESCAPE '\')
+              ORDER BY Users.ID`
+	return db.queryUsers(ctx, statement, pattern, pattern, pattern)
+}
+
+// ListUsersByUsernamePrefix returns at most limit users whose username starts
+// with prefix, ordered by username, for autocompletion
+// The match ignores the case of ASCII letters and uses the case-insensitive
+// index on Username, unless Config.CaseSensitiveUsernames is set.
+// limit has to be positive and is capped to MaxPageSize.
+func (db *DB) ListUsersByUsernamePrefix(prefix string, limit int) ([]Userdata, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.ListUsersByUsernamePrefixContext(ctx, prefix, limit)
+}
+
+// ListUsersByUsernamePrefixContext is like ListUsersByUsernamePrefix but uses ctx for the database calls
+func (db *DB) ListUsersByUsernamePrefixContext(ctx context.Context, prefix string, limit int) (_ []Userdata, err error) {
+	defer observe("ListUsersByUsernamePrefix", time.Now(), &err)
+	if limit <= 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidLimit, limit)
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	prefix = db.normalizeUsername(prefix)
+
+	// LIKE ignores the case of ASCII letters, so with CaseSensitiveUsernames
+	// the prefix is matched as a range of the binary index instead
+	if db.config.CaseSensitiveUsernames {
+		if prefix == "" {
+			statement := selectUsers + ` WHERE ` + notDeleted + ` ORDER BY Username LIMIT ?`
+			return db.queryUsers(ctx, statement, limit)
+		}
+		statement := selectUsers + ` WHERE ` + notDeleted + ` AND Username >= ? AND Username < ?
+              ORDER BY Username LIMIT ?`
+		return db.queryUsers(ctx, statement, prefix, prefixEnd(prefix), limit)
+	}
+
+	// The ORDER BY collation matches the index, so no sorting is needed
+	pattern := likeEscaper.Replace(prefix) + "%"
+	statement := selectUsers + ` WHERE ` + notDeleted + ` AND Username LIKE ? ESCAPE '\'
+              ORDER BY Username COLLATE NOCASE LIMIT ?`
+	return db.queryUsers(ctx, statement, pattern, limit)
+}
+
+// prefixEnd returns the smallest string, compared byte by byte, that is greater
+// than every string starting with the non-empty prefix. UTF-8 never contains
+// the byte 0xff, so incrementing the last byte cannot overflow.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	end[len(end)-1]++
+	return string(end)
+}
+
+// ListUsersBySurname returns the users whose surname is exactly surname,
+// ignoring case, ordered by ID
+// An empty slice is returned when nothing matches
+func (db *DB) ListUsersBySurname(surname string) ([]Userdata, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.ListUsersBySurnameContext(ctx, surname)
+}
+
+// ListUsersBySurnameContext is like ListUsersBySurname but uses ctx for the database calls
+func (db *DB) ListUsersBySurnameContext(ctx context.Context, surname string) (_ []Userdata, err error) {
+	defer observe("ListUsersBySurname", time.Now(), &err)
+	statement := selectUsers + ` WHERE ` + notDeleted + ` AND Userdata.Surname = ? COLLATE NOCASE ORDER BY Users.ID`
+	return db.queryUsers(ctx, statement, surname)
+}
+
+// ListUsersCreatedBetween returns the users created at or after start and
+// before end, ordered by ID, leaving out soft deleted users like ListUsers
+// Users of legacy databases whose CreatedAt was never set are never returned.
+// CreatedAt is stored with a precision of one second.
+func (db *DB) ListUsersCreatedBetween(start, end time.Time) ([]Userdata, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.ListUsersCreatedBetweenContext(ctx, start, end)
+}
+
+// ListUsersCreatedBetweenContext is like ListUsersCreatedBetween but uses ctx for the database calls
+func (db *DB) ListUsersCreatedBetweenContext(ctx context.Context, start, end time.Time) (_ []Userdata, err error) {
+	defer observe("ListUsersCreatedBetween", time.Now(), &err)
+	// A NULL CreatedAt fails both comparisons
+	statement := selectUsers + ` WHERE ` + notDeleted + `
+              AND Userdata.CreatedAt >= ? AND Userdata.CreatedAt < ? ORDER BY Users.ID`
+	return db.queryUsers(ctx, statement, start.Unix(), end.Unix())
+}
+
+// ListRecentUsers returns the n most recently created users, newest first,
+// leaving out soft deleted users like ListUsers
+// Users of legacy databases whose CreatedAt was never set come last, by
+// descending ID. n has to be positive and is capped to MaxPageSize.
+func (db *DB) ListRecentUsers(n int) ([]Userdata, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.ListRecentUsersContext(ctx, n)
+}
+
+// ListRecentUsersContext is like ListRecentUsers but uses ctx for the database calls
+func (db *DB) ListRecentUsersContext(ctx context.Context, n int) (_ []Userdata, err error) {
+	defer observe("ListRecentUsers", time.Now(), &err)
+	if n <= 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidLimit, n)
+	}
+	if n > MaxPageSize {
+		n = MaxPageSize
+	}
+
+	// NULL sorts last with DESC, and the ID orders the users created
+	// within the same second
+	statement := selectUsers + ` WHERE ` + notDeleted + `
+              ORDER BY Userdata.CreatedAt DESC, Users.ID DESC LIMIT ?`
+	return db.queryUsers(ctx, statement, n)
+}
+
+// likeEscaper escapes the special characters of a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// CountUsers returns the number of users in the database
+// Soft deleted users are not counted, so that it matches ListUsers
+func (db *DB) CountUsers() (int, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.CountUsersContext(ctx)
+}
+
+// CountUsersContext is like CountUsers but uses ctx for the database calls
+func (db *DB) CountUsersContext(ctx context.Context) (_ int, err error) {
+	defer observe("CountUsers", time.Now(), &err)
+	var count int
+	err = db.queryRow(ctx, `SELECT COUNT(*) FROM Users WHERE `+notDeleted).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// GetUserByID returns the user whose ID is provided in as input parameter
+// Returns ErrUserNotFound if there is no such user
+func (db *DB) GetUserByID(id int) (Userdata, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.GetUserByIDContext(ctx, id)
+}
+
+// GetUserByIDContext is like GetUserByID but uses ctx for the database calls
+func (db *DB) GetUserByIDContext(ctx context.Context, id int) (_ Userdata, err error) {
+	defer observe("GetUserByID", time.Now(), &err)
+	// LEFT JOIN, so that a user without a Userdata row is still found
+	statement := selectUsers + ` WHERE Users.ID = ?`
+
+	user, err := scanUser(db.queryRow(ctx, statement, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Userdata{}, &UserNotFoundError{ID: id, err: err}
+	}
+	if err != nil {
+		return Userdata{}, err
+	}
+	return user, nil
+}
+
+// GetUserData returns the Userdata row of the user with the given ID without
+// reading the Users table, Username and DeletedAt are left empty
+// Returns ErrUserNotFound if there is no Userdata row for userID
+func (db *DB) GetUserData(userID int) (Userdata, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.GetUserDataContext(ctx, userID)
+}
+
+// GetUserDataContext is like GetUserData but uses ctx for the database calls
+func (db *DB) GetUserDataContext(ctx context.Context, userID int) (_ Userdata, err error) {
+	defer observe("GetUserData", time.Now(), &err)
+	// The placeholder columns keep the order of selectUsers for scanUser()
+	statement := `SELECT UserID, '', Name, Surname, Description, Email, CreatedAt, UpdatedAt, NULL
+              FROM Userdata WHERE UserID = ?`
+
+	user, err := scanUser(db.queryRow(ctx, statement, userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Userdata{}, &UserNotFoundError{ID: userID, err: err}
+	}
+	if err != nil {
+		return Userdata{}, err
+	}
+	return user, nil
+}
+
+// GetUsersByIDs returns the users with the given IDs in a map keyed by ID
+// IDs that do not belong to any user are simply absent from the map.
+func (db *DB) GetUsersByIDs(ids []int) (map[int]Userdata, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.GetUsersByIDsContext(ctx, ids)
+}
+
+// maxParams is how many parameters a batch query binds at most,
+// staying well below the SQLITE_MAX_VARIABLE_NUMBER of older SQLite versions
+const maxParams = 500
+
+// GetUsersByIDsContext is like GetUsersByIDs but uses ctx for the database calls
+func (db *DB) GetUsersByIDsContext(ctx context.Context, ids []int) (_ map[int]Userdata, err error) {
+	defer observe("GetUsersByIDs", time.Now(), &err)
+	users := make(map[int]Userdata, len(ids))
+	for chunk := range slices.Chunk(ids, maxParams) {
+		statement := selectUsers + ` WHERE Users.ID IN (` + placeholders(len(chunk)) + `)`
+		err := db.eachUser(ctx, func(d Userdata) error {
+			users[d.ID] = d
+			return nil
+		}, statement, intArgs(chunk)...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// placeholders returns n comma separated ? placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// intArgs returns ints as query arguments
+func intArgs(ints []int) []any {
+	args := make([]any, len(ints))
+	for i, n := range ints {
+		args[i] = n
+	}
+	return args
+}
+
+// GetUserByUsername returns the user whose username is provided in as input parameter
+// Returns ErrUserNotFound if there is no such user
+func (db *DB) GetUserByUsername(username string) (Userdata, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.GetUserByUsernameContext(ctx, username)
+}
+
+// GetUserByUsernameContext is like GetUserByUsername but uses ctx for the database calls
+func (db *DB) GetUserByUsernameContext(ctx context.Context, username string) (_ Userdata, err error) {
+	defer observe("GetUserByUsername", time.Now(), &err)
+	username = db.normalizeUsername(username)
+
+	statement := selectUsers + ` WHERE Users.Username = ?`
+
+	user, err := scanUser(db.queryRow(ctx, statement, username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Userdata{}, &UserNotFoundError{Username: username, err: err}
+	}
+	if err != nil {
+		return Userdata{}, err
+	}
+	return user, nil
+}
+
+// GetUsersByUsernames returns the users with the given usernames in a map
+// keyed by their normalized username
+// Usernames that do not belong to any user are simply absent from the map.
+func (db *DB) GetUsersByUsernames(usernames []string) (map[string]Userdata, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.GetUsersByUsernamesContext(ctx, usernames)
+}
+
+// GetUsersByUsernamesContext is like GetUsersByUsernames but uses ctx for the database calls
+func (db *DB) GetUsersByUsernamesContext(ctx context.Context, usernames []string) (_ map[string]Userdata, err error) {
+	defer observe("GetUsersByUsernames", time.Now(), &err)
+	args := make([]any, len(usernames))
+	for i, username := range usernames {
+		args[i] = db.normalizeUsername(username)
+	}
+
+	users := make(map[string]Userdata, len(usernames))
+	for chunk := range slices.Chunk(args, maxParams) {
+		statement := selectUsers + ` WHERE Users.Username IN (` + placeholders(len(chunk)) + `)`
+		err := db.eachUser(ctx, func(d Userdata) error {
+			users[d.Username] = d
+			return nil
+		}, statement, chunk...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// UpdateUser is for updating an existing user
+// The user is found by d.Username. If d.ID is not zero it has to be the ID
+// of that user, otherwise ErrIDMismatch is returned and nothing is written.
+// Returns ErrUserNotFound if there is no such user or it has no Userdata row,
+// a nil error always means that the row was written.
+func (db *DB) UpdateUser(d Userdata) error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.UpdateUserContext(ctx, d)
+}
+
+// UpdateUserContext is like UpdateUser but uses ctx for the database calls
+func (db *DB) UpdateUserContext(ctx context.Context, d Userdata) (err error) {
+	defer observe("UpdateUser", time.Now(), &err)
+	// The lookup and the update happen in one transaction,
+	// so that the user cannot be deleted in between
+	return db.withTx(ctx, []string{selectUserID, updateUserdata}, func(tx *Tx) error {
+		return tx.UpdateUser(d)
+	})
+}
+
+// UpdateUserByUsername updates the Name, Surname and Description of the user
+// with the given username, leaving its Email as it is
+// Returns ErrInvalidUsername for an empty username and ErrUserNotFound if there
+// is no such user or it has no Userdata row
+func (db *DB) UpdateUserByUsername(username, name, surname, description string) error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.UpdateUserByUsernameContext(ctx, username, name, surname, description)
+}
+
+// UpdateUserByUsernameContext is like UpdateUserByUsername but uses ctx for the database calls
+func (db *DB) UpdateUserByUsernameContext(ctx context.Context, username, name, surname, description string) (err error) {
+	defer observe("UpdateUserByUsername", time.Now(), &err)
+	username = db.normalizeUsername(username)
+	err = validateUsername(username)
+	if err != nil {
+		return err
+	}
+	description, err = db.normalizeDescription(description)
+	if err != nil {
+		return err
+	}
+
+	// The ID is resolved by the statement itself, so no transaction is needed
+	statement := `UPDATE Userdata SET Name = ?, Surname = ?, Description = ?, UpdatedAt = ?
+              WHERE UserID = (SELECT ID FROM Users WHERE Username = ?)`
+	res, err := db.exec(ctx, statement, name, surname, description, time.Now().Unix(), username)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return &UserNotFoundError{Username: username}
+	}
+	return nil
+}
+
+// UpsertUser adds d as a new user if its username does not exist yet,
+// otherwise it updates the Name, Surname and Description of the existing user
+// and keeps its Email. An existing user without a Userdata row gets one.
+// Returns the ID of the user in both cases
+func (db *DB) UpsertUser(d Userdata) (int, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.UpsertUserContext(ctx, d)
+}
+
+// UpsertUserContext is like UpsertUser but uses ctx for the database calls
+func (db *DB) UpsertUserContext(ctx context.Context, d Userdata) (_ int, err error) {
+	defer observe("UpsertUser", time.Now(), &err)
+	hash, err := hashPassword(d.Password)
+	if err != nil {
+		return -1, err
+	}
+
+	userID := -1
+	err = db.withTx(ctx, upsertQueries, func(tx *Tx) error {
+		var err error
+		userID, _, err = tx.upsertUser(d, hash)
+		return err
+	})
+	if err != nil {
+		return -1, err
+	}
+	return userID, nil
+}
+
+// upsertQueries are the statements prepared for UpsertUser and UpsertUsers
+var upsertQueries = []string{selectUserID, insertUsers, insertUserdata, upsertUserdata}
+
+// UpsertUsers is the batch form of UpsertUser, all users are added or updated
+// in a single transaction, so any error rolls back the whole batch
+// Returns how many users were added and how many were updated
+func (db *DB) UpsertUsers(users []Userdata) (added, updated int, err error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.UpsertUsersContext(ctx, users)
+}
+
+// UpsertUsersContext is like UpsertUsers but uses ctx for the database calls
+func (db *DB) UpsertUsersContext(ctx context.Context, users []Userdata) (added, updated int, err error) {
+	defer observe("UpsertUsers", time.Now(), &err)
+	hashes, err := hashPasswords(users)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = db.withTx(ctx, upsertQueries, func(tx *Tx) error {
+		added, updated = 0, 0
+		for i, d := range users {
+			_, isNew, err := tx.upsertUser(d, hashes[i])
+			if err != nil {
+				return err
+			}
+			if isNew {
+				added++
+			} else {
+				updated++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return added, updated, nil
+}
+
+// UpdateUsername changes the username of the user with the given ID
+// Returns ErrUserExists if newUsername is already used by another user,
+// ErrInvalidUsername if it is empty and ErrUserNotFound if there is no user with that ID
+func (db *DB) UpdateUsername(id int, newUsername string) error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.UpdateUsernameContext(ctx, id, newUsername)
+}
+
+// UpdateUsernameContext is like UpdateUsername but uses ctx for the database calls
+func (db *DB) UpdateUsernameContext(ctx context.Context, id int, newUsername string) (err error) {
+	defer observe("UpdateUsername", time.Now(), &err)
+	newUsername = db.normalizeUsername(newUsername)
+	err = validateUsername(newUsername)
+	if err != nil {
+		return err
+	}
+
+	userID, err := db.exists(ctx, newUsername)
+	if err != nil {
+		return err
+	}
+	if userID != -1 && userID != id {
+		return &UserExistsError{Username: newUsername}
+	}
+
+	statement := `UPDATE Users SET Username = ? WHERE ID = ?`
+	res, err := db.exec(ctx, statement, newUsername, id)
+	if isUniqueViolation(err) {
+		return &UserExistsError{Username: newUsername}
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return &UserNotFoundError{ID: id}
+	}
+	return nil
+}
+
+// updatableFields lists the Userdata columns accepted by UpdateUserFields
+var updatableFields = []string{"Name", "Surname", "Description", "Email"}
+
+// UpdateUserFields updates only the given columns of the user with the given ID
+// The keys of fields are column names and have to be one of Name, Surname,
+// Description or Email, otherwise ErrInvalidField is returned. The values have
+// to be strings: any other Name or Surname fails with ErrInvalidField, Email
+// with ErrInvalidEmail and Description with ErrInvalidDescription.
+// Returns ErrUserNotFound if the user has no Userdata row
+func (db *DB) UpdateUserFields(id int, fields map[string]any) error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.UpdateUserFieldsContext(ctx, id, fields)
+}
+
+// UpdateUserFieldsContext is like UpdateUserFields but uses ctx for the database calls
+func (db *DB) UpdateUserFieldsContext(ctx context.Context, id int, fields map[string]any) (err error) {
+	defer observe("UpdateUserFields", time.Now(), &err)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	// Sorted, so that the same fields always produce the same statement
+	columns := make([]string, 0, len(fields))
+	for column := range fields {
+		if !slices.Contains(updatableFields, column) {
+			return fmt.Errorf("%w: %s", ErrInvalidField, column)
+		}
+		columns = append(columns, column)
+	}
+	slices.Sort(columns)
+
+	if email, ok := fields["Email"]; ok {
+		value, ok := email.(string)
+		if !ok {
+			return fmt.Errorf("%w: Email has to be a string", ErrInvalidEmail)
+		}
+		err := validateEmail(value)
+		if err != nil {
+			return err
+		}
+	}
+	description, isDescription := fields["Description"]
+	if isDescription {
+		value, ok := description.(string)
+		if !ok {
+			return fmt.Errorf("%w: Description has to be a string", ErrInvalidDescription)
+		}
+		description, err = db.normalizeDescription(value)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Only allowlisted column names end up in the statement,
+	// the values are always passed as parameters
+	set := make([]string, 0, len(columns))
+	args := make([]any, 0, len(columns)+1)
+	for _, column := range columns {
+		set = append(set, column+" = ?")
+		if column == "Description" {
+			args = append(args, description)
+			continue
+		}
+		// Email has been checked above, Name and Surname are checked here
+		value, ok := fields[column].(string)
+		if !ok {
+			return fmt.Errorf("%w: %s has to be a string", ErrInvalidField, column)
+		}
+		args = append(args, value)
+	}
+	set = append(set, "UpdatedAt = ?")
+	args = append(args, time.Now().Unix(), id)
+
+	statement := `UPDATE Userdata SET ` + strings.Join(set, ", ") + ` WHERE UserID = ?`
+	res, err := db.exec(ctx, statement, args...)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return &UserNotFoundError{ID: id}
+	}
+	return nil
+}
+
+// SetDescription updates only the Description of the user with the given ID
+// The description is checked against Config.MaxDescriptionLength like in UpdateUser.
+// Returns ErrUserNotFound if the user has no Userdata row
+func (db *DB) SetDescription(id int, description string) error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.SetDescriptionContext(ctx, id, description)
+}
+
+// SetDescriptionContext is like SetDescription but uses ctx for the database calls
+func (db *DB) SetDescriptionContext(ctx context.Context, id int, description string) (err error) {
+	defer observe("SetDescription", time.Now(), &err)
+	description, err = db.normalizeDescription(description)
+	if err != nil {
+		return err
+	}
+
+	statement := `UPDATE Userdata SET Description = ?, UpdatedAt = ? WHERE UserID = ?`
+	res, err := db.exec(ctx, statement, description, time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return &UserNotFoundError{ID: id}
+	}
+	return nil
+}
+
+// UpdateName updates the Name and Surname of the user with the given ID together
+// Both have to be non-empty and at most 100 characters long, otherwise
+// ErrInvalidName is returned and nothing is updated.
+// Returns ErrUserNotFound if the user has no Userdata row
+func (db *DB) UpdateName(id int, name, surname string) error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.UpdateNameContext(ctx, id, name, surname)
+}
+
+// UpdateNameContext is like UpdateName but uses ctx for the database calls
+func (db *DB) UpdateNameContext(ctx context.Context, id int, name, surname string) (err error) {
+	defer observe("UpdateName", time.Now(), &err)
+	err = validateName("Name", name)
+	if err != nil {
+		return err
+	}
+	err = validateName("Surname", surname)
+	if err != nil {
+		return err
+	}
+
+	statement := `UPDATE Userdata SET Name = ?, Surname = ?, UpdatedAt = ? WHERE UserID = ?`
+	res, err := db.exec(ctx, statement, name, surname, time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return &UserNotFoundError{ID: id}
+	}
+	return nil
+}
+
+// GetUserByEmail returns the user whose email is provided in as input parameter
+// The email is compared case-insensitively. Emails are not unique, if several
+// users have it the one with the lowest ID is returned.
+// Returns ErrInvalidEmail for an empty email and ErrUserNotFound if there is no such user
+func (db *DB) GetUserByEmail(email string) (Userdata, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.GetUserByEmailContext(ctx, email)
+}
+
+// GetUserByEmailContext is like GetUserByEmail but uses ctx for the database calls
+func (db *DB) GetUserByEmailContext(ctx context.Context, email string) (_ Userdata, err error) {
+	defer observe("GetUserByEmail", time.Now(), &err)
+	// Users added without an email have an empty one, which is no match
+	if strings.TrimSpace(email) == "" {
+		return Userdata{}, fmt.Errorf("%w: email is empty", ErrInvalidEmail)
+	}
+	statement := selectUsers + ` WHERE Userdata.Email = ? COLLATE NOCASE ORDER BY Users.ID LIMIT 1`
+
+	user, err := scanUser(db.queryRow(ctx, statement, email))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Userdata{}, &UserNotFoundError{Email: email, err: err}
+	}
+	if err != nil {
+		return Userdata{}, err
+	}
+	return user, nil
 }
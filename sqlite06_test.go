@@ -0,0 +1,564 @@
+package sqlite06_test
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tunacinsoy/sqlite06"
+)
+
+// newTestDB returns an in-memory DB that is closed at the end of the test
+func newTestDB(t *testing.T) *sqlite06.DB {
+	t.Helper()
+	db, err := sqlite06.NewInMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// TestConcurrentWrites runs the package-level functions from many goroutines
+// on one file with the default Config, run it with -race
+func TestConcurrentWrites(t *testing.T) {
+	sqlite06.SetFilename(filepath.Join(t.TempDir(), "concurrent.db"))
+	t.Cleanup(func() {
+		sqlite06.Close()
+		sqlite06.SetFilename("")
+	})
+	err := sqlite06.InitDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const goroutines, users = 8, 20
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < users; j++ {
+				id, err := sqlite06.AddUser(sqlite06.Userdata{Username: fmt.Sprintf("user%d_%d", i, j)})
+				if err != nil {
+					t.Errorf("AddUser: %v", err)
+					continue
+				}
+				_, err = sqlite06.ListUsers()
+				if err != nil {
+					t.Errorf("ListUsers: %v", err)
+				}
+				// Every other user is kept, so that the count below means something
+				if j%2 == 0 {
+					continue
+				}
+				err = sqlite06.DeleteUser(id)
+				if err != nil {
+					t.Errorf("DeleteUser: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	n, err := sqlite06.CountUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := goroutines * users / 2; n != want {
+		t.Errorf("CountUsers() = %d, want %d", n, want)
+	}
+}
+
+// TestListUsersWithoutUserdata checks that a user whose Userdata row is
+// missing is still listed, with empty Userdata fields
+func TestListUsersWithoutUserdata(t *testing.T) {
+	db := newTestDB(t)
+	_, err := db.AddUser(sqlite06.Userdata{Username: "complete", Name: "Full"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DB().Exec(`INSERT INTO Users (Username) VALUES ('bare')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := db.ListUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("ListUsers() returned %d users, want 2", len(users))
+	}
+	if users[1].Username != "bare" || users[1].Name != "" {
+		t.Errorf("ListUsers()[1] = %+v, want user bare without Userdata", users[1])
+	}
+}
+
+// TestMigrateFromBaseline starts from the two tables of the first version
+// of the package and migrates them to the current schema
+func TestMigrateFromBaseline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "baseline.db")
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		`CREATE TABLE Users (ID INTEGER PRIMARY KEY, Username TEXT)`,
+		`CREATE TABLE Userdata (UserID INTEGER NOT NULL, Name TEXT, Surname TEXT, Description TEXT)`,
+		`INSERT INTO Users VALUES (1, 'alice'), (2, 'bob')`,
+		`INSERT INTO Userdata VALUES (1, 'Alice', 'Smith', 'first'), (2, 'Bob', 'Jones', 'second')`,
+		// Orphaned row, which the foreign key of the migrations does not allow
+		`INSERT INTO Userdata VALUES (99, 'Ghost', '', '')`,
+	} {
+		_, err = raw.Exec(statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw.Close()
+
+	db, err := sqlite06.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := db.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != sqlite06.SchemaVersion {
+		t.Errorf("SchemaVersion() = %d, want %d", version, sqlite06.SchemaVersion)
+	}
+
+	users, err := db.ListUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("ListUsers() returned %d users, want 2", len(users))
+	}
+	alice := users[0]
+	if alice.Username != "alice" || alice.Name != "Alice" || alice.Surname != "Smith" || alice.Description != "first" {
+		t.Errorf("ListUsers()[0] = %+v, want the data of alice", alice)
+	}
+
+	orphans, err := db.FindOrphanedUserdata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("FindOrphanedUserdata() = %v after Migrate, want none", orphans)
+	}
+}
+
+// TestUsernameWhitespace checks that surrounding whitespace of usernames is
+// ignored and whitespace inside them is kept
+func TestUsernameWhitespace(t *testing.T) {
+	db := newTestDB(t)
+	id, err := db.AddUser(sqlite06.Userdata{Username: " alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.AddUser(sqlite06.Userdata{Username: "alice "})
+	if !errors.Is(err, sqlite06.ErrUserExists) {
+		t.Errorf(`AddUser("alice ") error = %v, want ErrUserExists`, err)
+	}
+	user, err := db.GetUserByUsername("alice ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != id || user.Username != "alice" {
+		t.Errorf(`GetUserByUsername("alice ") = %+v, want alice with ID %d`, user, id)
+	}
+	exists, err := db.UserExists("alice ")
+	if err != nil || !exists {
+		t.Errorf(`UserExists("alice ") = %v, %v, want true`, exists, err)
+	}
+
+	exists, err = db.UserExists("al ice")
+	if err != nil || exists {
+		t.Errorf(`UserExists("al ice") = %v, %v, want false`, exists, err)
+	}
+	_, err = db.AddUser(sqlite06.Userdata{Username: "al ice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = db.GetUserByUsername("al ice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "al ice" {
+		t.Errorf(`GetUserByUsername("al ice").Username = %q, want "al ice"`, user.Username)
+	}
+}
+
+// TestMigrateReadOnly checks that Migrate does not write to an up to date
+// database, so that it works on one opened with Config.ReadOnly
+func TestMigrateReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "readonly.db")
+	db, err := sqlite06.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Migrate()
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = sqlite06.NewWithConfig(path, sqlite06.Config{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Migrate()
+	if err != nil {
+		t.Errorf("Migrate() on an up to date read-only database: %v", err)
+	}
+	version, err := db.PackageVersion()
+	if err != nil || version != sqlite06.Version {
+		t.Errorf("PackageVersion() = %q, %v, want %q", version, err, sqlite06.Version)
+	}
+}
+
+// TestExportSkipsDeleted checks that soft deleted users are not exported
+func TestExportSkipsDeleted(t *testing.T) {
+	db := newTestDB(t)
+	_, err := db.AddUser(sqlite06.Userdata{Username: "kept"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.AddUser(sqlite06.Userdata{Username: "deleted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SoftDelete(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var jsonOut, csvOut strings.Builder
+	err = db.ExportJSON(&jsonOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.ExportCSV(&csvOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, out := range map[string]string{"ExportJSON": jsonOut.String(), "ExportCSV": csvOut.String()} {
+		if !strings.Contains(out, "kept") || strings.Contains(out, "deleted") {
+			t.Errorf("%s wrote %q, want only the user kept", name, out)
+		}
+	}
+}
+
+// TestUsernamePrefixCaseSensitive checks that the prefix match keeps the case
+// of ASCII letters with Config.CaseSensitiveUsernames
+func TestUsernamePrefixCaseSensitive(t *testing.T) {
+	db, err := sqlite06.NewWithConfig(filepath.Join(t.TempDir(), "case.db"),
+		sqlite06.Config{CaseSensitiveUsernames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"Alice", "alice", "alfred", "bob"} {
+		_, err = db.AddUser(sqlite06.Userdata{Username: username})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for prefix, want := range map[string][]string{
+		"al": {"alfred", "alice"},
+		"Al": {"Alice"},
+		"":   {"Alice", "alfred", "alice", "bob"},
+	} {
+		users, err := db.ListUsersByUsernamePrefix(prefix, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, user := range users {
+			got = append(got, user.Username)
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("ListUsersByUsernamePrefix(%q) = %v, want %v", prefix, got, want)
+		}
+	}
+}
+
+// TestUpdateUserFieldsDescriptionType checks that a Description that is not
+// a string is rejected instead of being stored as it is
+func TestUpdateUserFieldsDescriptionType(t *testing.T) {
+	db := newTestDB(t)
+	id, err := db.AddUser(sqlite06.Userdata{Username: "alice", Description: "before"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.UpdateUserFields(id, map[string]any{"Description": 42})
+	if !errors.Is(err, sqlite06.ErrInvalidDescription) {
+		t.Errorf("UpdateUserFields with an int Description: error = %v, want ErrInvalidDescription", err)
+	}
+	user, err := db.GetUserByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Description != "before" {
+		t.Errorf("Description = %q after the rejected update, want %q", user.Description, "before")
+	}
+}
+
+// TestDatabaseFileExistsURI checks that file: URIs, with parameters, a host
+// or percent-encoded characters, name the same file as the plain path
+func TestDatabaseFileExistsURI(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uri db.db")
+	db, err := sqlite06.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Migrate()
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, uri := range []string{
+		"file:" + path + "?mode=ro",
+		"file://localhost" + path,
+		"file://" + strings.ReplaceAll(path, "uri db", "uri%20db"),
+	} {
+		exists, err := sqlite06.DatabaseFileExists(uri)
+		if err != nil || !exists {
+			t.Errorf("DatabaseFileExists(%q) = %v, %v, want true", uri, exists, err)
+		}
+	}
+}
+
+// TestDeleteUserByUsernameBlank checks that a blank username is rejected
+// as invalid rather than looked up, by UpdateUserByUsername too
+func TestDeleteUserByUsernameBlank(t *testing.T) {
+	db := newTestDB(t)
+	for _, username := range []string{"", "   "} {
+		err := db.DeleteUserByUsername(username)
+		if !errors.Is(err, sqlite06.ErrInvalidUsername) {
+			t.Errorf("DeleteUserByUsername(%q) error = %v, want ErrInvalidUsername", username, err)
+		}
+		err = db.UpdateUserByUsername(username, "Name", "Surname", "")
+		if !errors.Is(err, sqlite06.ErrInvalidUsername) {
+			t.Errorf("UpdateUserByUsername(%q) error = %v, want ErrInvalidUsername", username, err)
+		}
+	}
+
+	err := db.DeleteUserByUsername("nobody")
+	if !errors.Is(err, sqlite06.ErrUserNotFound) || strings.Contains(err.Error(), "ID") {
+		t.Errorf(`DeleteUserByUsername("nobody") error = %v, want ErrUserNotFound naming the username`, err)
+	}
+}
+
+// TestListUsersPagedWithWriter checks that ListUsersPaged reads while another
+// connection holds a write transaction, instead of waiting for its lock
+func TestListUsersPagedWithWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "paged.db")
+	writer, err := sqlite06.NewWithConfig(path, sqlite06.Config{WAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	err = writer.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = writer.AddUser(sqlite06.Userdata{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := writer.DB().Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO Users (Username) VALUES ('pending')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := sqlite06.NewWithConfig(path, sqlite06.Config{BusyTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	users, total, err := reader.ListUsersPaged(10, 0)
+	if err != nil {
+		t.Fatalf("ListUsersPaged while a write transaction is open: %v", err)
+	}
+	if total != 1 || len(users) != 1 || users[0].Username != "alice" {
+		t.Errorf("ListUsersPaged() = %v, %d, want only alice", users, total)
+	}
+
+	// The read transaction has ended, the reader can write once the writer is done
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = reader.AddUser(sqlite06.Userdata{Username: "bob"})
+	if err != nil {
+		t.Errorf("AddUser after ListUsersPaged: %v", err)
+	}
+}
+
+// TestAddUsersHashesOutsideTransaction checks that the passwords of AddUsers
+// are hashed before the write lock is taken, so that another connection can
+// write in the meantime
+func TestAddUsersHashesOutsideTransaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hash.db")
+	config := sqlite06.Config{WAL: true, BusyTimeout: 20 * time.Millisecond}
+	first, err := sqlite06.NewWithConfig(path, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	err = first.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sqlite06.NewWithConfig(path, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	// bcrypt takes far longer than BusyTimeout for these
+	var users []sqlite06.Userdata
+	for i := 0; i < 3; i++ {
+		users = append(users, sqlite06.Userdata{Username: fmt.Sprintf("hashed%d", i), Password: "secret"})
+	}
+	done := make(chan error)
+	go func() {
+		_, err := first.AddUsers(users)
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	_, err = second.AddUser(sqlite06.Userdata{Username: "meanwhile"})
+	if err != nil {
+		t.Errorf("AddUser while AddUsers hashes passwords: %v", err)
+	}
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := first.VerifyPassword("hashed2", "secret")
+	if err != nil || !ok {
+		t.Errorf(`VerifyPassword("hashed2") = %v, %v, want true`, ok, err)
+	}
+}
+
+// TestUpsertUserExisting checks that UpsertUser keeps the Email of an existing
+// user and writes the Userdata row of a user that has none
+func TestUpsertUserExisting(t *testing.T) {
+	db := newTestDB(t)
+	id, err := db.AddUser(sqlite06.Userdata{Username: "alice", Name: "A", Email: "a@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upserted, err := db.UpsertUser(sqlite06.Userdata{Username: "alice", Name: "B"})
+	if err != nil || upserted != id {
+		t.Fatalf("UpsertUser(alice) = %d, %v, want %d", upserted, err, id)
+	}
+	user, err := db.GetUserByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "B" || user.Email != "a@example.com" {
+		t.Errorf("after UpsertUser: Name = %q, Email = %q, want B and a@example.com", user.Name, user.Email)
+	}
+
+	_, err = db.DB().Exec(`INSERT INTO Users (Username) VALUES ('bare')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, updated, err := db.UpsertUsers([]sqlite06.Userdata{{Username: "bare", Name: "Bare"}})
+	if err != nil || added != 0 || updated != 1 {
+		t.Fatalf("UpsertUsers(bare) = %d, %d, %v, want 0, 1", added, updated, err)
+	}
+	user, err = db.GetUserByUsername("bare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "Bare" {
+		t.Errorf("Name of bare after UpsertUsers = %q, want Bare", user.Name)
+	}
+}
+
+// TestGetUserByEmail checks that an empty email matches nobody and that the
+// first of several users with the same email is returned
+func TestGetUserByEmail(t *testing.T) {
+	db := newTestDB(t)
+	for _, d := range []sqlite06.Userdata{
+		{Username: "noemail"},
+		{Username: "first", Email: "shared@example.com"},
+		{Username: "second", Email: "Shared@example.com"},
+	} {
+		_, err := db.AddUser(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := db.GetUserByEmail("")
+	if !errors.Is(err, sqlite06.ErrInvalidEmail) {
+		t.Errorf(`GetUserByEmail("") error = %v, want ErrInvalidEmail`, err)
+	}
+	user, err := db.GetUserByEmail("SHARED@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "first" {
+		t.Errorf("GetUserByEmail of a shared email = %s, want first", user.Username)
+	}
+}
+
+// TestUpdateUserFieldsNameType checks that a Name or Surname that is not
+// a string is rejected with ErrInvalidField
+func TestUpdateUserFieldsNameType(t *testing.T) {
+	db := newTestDB(t)
+	id, err := db.AddUser(sqlite06.Userdata{Username: "alice", Name: "Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range []any{nil, []byte{0xff, 0xfe}, struct{}{}, 42} {
+		for _, column := range []string{"Name", "Surname"} {
+			err = db.UpdateUserFields(id, map[string]any{column: value})
+			if !errors.Is(err, sqlite06.ErrInvalidField) {
+				t.Errorf("UpdateUserFields(%s: %#v) error = %v, want ErrInvalidField", column, value, err)
+			}
+		}
+	}
+	user, err := db.GetUserByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "Alice" {
+		t.Errorf("Name = %q after the rejected updates, want Alice", user.Name)
+	}
+}
@@ -0,0 +1,80 @@
+package sqlite06
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Stats is a snapshot of the size of the database
+type Stats struct {
+	// Users is the number of rows in the Users table, soft deleted users included
+	Users int
+	// DeletedUsers is the number of soft deleted users
+	DeletedUsers int
+	// UsersWithoutUserdata is the number of users that have no Userdata row
+	UsersWithoutUserdata int
+	// FileSize is the size in bytes of the database file,
+	// it is 0 for in-memory databases and those of NewWithDB
+	FileSize int64
+}
+
+// Stats returns the current Stats of the database
+func (db *DB) Stats() (Stats, error) {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.StatsContext(ctx)
+}
+
+// StatsContext is like Stats but uses ctx for the database calls
+func (db *DB) StatsContext(ctx context.Context) (_ Stats, err error) {
+	defer observe("Stats", time.Now(), &err)
+	var stats Stats
+
+	statement := `SELECT COUNT(*), COUNT(DeletedAt),
+              COUNT(*) FILTER (WHERE NOT EXISTS (SELECT 1 FROM Userdata WHERE Userdata.UserID = Users.ID))
+              FROM Users`
+	err = db.queryRow(ctx, statement).Scan(&stats.Users, &stats.DeletedUsers, &stats.UsersWithoutUserdata)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	if !isMemory(db.filename) && !db.external {
+		info, err := os.Stat(filePath(db.filename))
+		if err != nil {
+			return Stats{}, err
+		}
+		stats.FileSize = info.Size()
+	}
+	return stats, nil
+}
+
+// filePath returns the path of the file named by filename,
+// which may also be a "file:" URI with query parameters
+// The path of a URI is percent-decoded, like SQLite does and like uriEscaper
+// expects. A plain filename is only cut at its query, as the driver does.
+func filePath(filename string) string {
+	if !strings.HasPrefix(filename, "file:") {
+		path, _, _ := strings.Cut(filename, "?")
+		return path
+	}
+
+	// "file:data.db" is opaque, "file:/data.db", "file:///data.db" and
+	// "file://localhost/data.db" have a path
+	u, err := url.Parse(filename)
+	if err != nil {
+		path, _, _ := strings.Cut(strings.TrimPrefix(filename, "file:"), "?")
+		return path
+	}
+	path := u.Opaque
+	if path == "" {
+		path = u.EscapedPath()
+	}
+	unescaped, err := url.PathUnescape(path)
+	if err != nil {
+		return path
+	}
+	return unescaped
+}
@@ -0,0 +1,55 @@
+package sqlite06
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+)
+
+// stmtCache keeps the prepared statements of the hot paths for the whole
+// lifetime of a DB, so that SQLite parses their SQL only once.
+// Statements are prepared on first use; a failed prepare is not cached,
+// since it may only mean that the tables have not been created yet.
+type stmtCache struct {
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+// stmt returns the prepared statement for query, preparing it if needed
+// Within a transaction, use tx.StmtContext() on the returned statement.
+func (db *DB) stmt(ctx context.Context, query string) (*sql.Stmt, error) {
+	db.cache.mu.Lock()
+	defer db.cache.mu.Unlock()
+
+	if stmt, ok := db.cache.stmts[query]; ok {
+		return stmt, nil
+	}
+	// Keeps a statement from being cached after Close emptied the cache
+	if db.closed.Load() {
+		return nil, ErrClosed
+	}
+
+	stmt, err := db.conn.Load().PrepareContext(ctx, db.sql(query))
+	if err != nil {
+		return nil, err
+	}
+	if db.cache.stmts == nil {
+		db.cache.stmts = map[string]*sql.Stmt{}
+	}
+	db.cache.stmts[query] = stmt
+	return stmt, nil
+}
+
+// close closes all the cached statements
+func (c *stmtCache) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	for _, stmt := range c.stmts {
+		errs = append(errs, stmt.Close())
+	}
+	c.stmts = nil
+	return errors.Join(errs...)
+}
@@ -0,0 +1,65 @@
+package sqlite06
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The table names used when Config leaves them empty
+const (
+	defaultUsersTable    = "Users"
+	defaultUserdataTable = "Userdata"
+	defaultMetadataTable = "Metadata"
+)
+
+// identifier is what a configured table name has to look like
+// Table names cannot be bound as parameters, so nothing else is let into the SQL.
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// tableNames returns the replacer that turns the default table names used in
+// the queries of this package into the ones of config, nil if config keeps the defaults
+// Returns ErrInvalidTableName if a name is not a plain SQL identifier
+func (config Config) tableNames() (*strings.Replacer, error) {
+	names := []struct{ configured, table string }{
+		{config.UsersTable, defaultUsersTable},
+		{config.UserdataTable, defaultUserdataTable},
+		{config.MetadataTable, defaultMetadataTable},
+	}
+
+	var pairs []string
+	seen := map[string]bool{}
+	for _, n := range names {
+		name := n.configured
+		if name == "" {
+			name = n.table
+		}
+		if !identifier.MatchString(name) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidTableName, name)
+		}
+		// SQLite compares table names case-insensitively
+		if seen[strings.ToLower(name)] {
+			return nil, fmt.Errorf("%w: %q is used twice", ErrInvalidTableName, name)
+		}
+		seen[strings.ToLower(name)] = true
+		if name != n.table {
+			pairs = append(pairs, n.table, name)
+		}
+	}
+
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	return strings.NewReplacer(pairs...), nil
+}
+
+// sql returns query with the table names of db
+// The queries of this package are written with the default names, every one
+// of them has to pass through here before it reaches the database.
+// Names derived from a table name, like the UsersUsername index, change with it.
+func (db *DB) sql(query string) string {
+	if db.tables == nil {
+		return query
+	}
+	return db.tables.Replace(query)
+}
@@ -0,0 +1,293 @@
+package sqlite06
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Tx is a database transaction in which several operations of this package
+// can be composed into one atomic unit. It is created by WithTransaction
+// and only valid inside the function passed to it.
+// All its operations use the context the transaction was started with.
+type Tx struct {
+	db  *DB
+	tx  *sql.Tx
+	ctx context.Context
+	// prepared holds statements prepared on the DB before the transaction
+	// started, keyed by their query. Queries not in it are run directly.
+	prepared map[string]*sql.Stmt
+}
+
+// The statements shared by the DB and Tx operations
+const (
+	selectUserID   = `SELECT ID FROM Users WHERE Username = ?`
+	insertUsers    = `INSERT INTO Users (Username, PasswordHash) VALUES (?, ?)`
+	updateUserdata = `UPDATE Userdata SET Name = ?, Surname = ?, Description = ?, Email = ?, UpdatedAt = ? WHERE UserID = ?`
+	// upsertUserdata is updateUserdata without Email, which UpsertUser keeps
+	upsertUserdata = `UPDATE Userdata SET Name = ?, Surname = ?, Description = ?, UpdatedAt = ? WHERE UserID = ?`
+)
+
+// WithTransaction runs fn inside a transaction
+// The transaction is committed if fn returns nil and rolled back otherwise,
+// in which case the error of fn is returned.
+// If Config.MaxRetries is set, fn may be called again when the database is busy,
+// so it should not have side effects outside the transaction.
+func (db *DB) WithTransaction(fn func(tx *Tx) error) error {
+	ctx, cancel := db.defaultContext()
+	defer cancel()
+	return db.WithTransactionContext(ctx, fn)
+}
+
+// WithTransactionContext is like WithTransaction but uses ctx for the database calls
+func (db *DB) WithTransactionContext(ctx context.Context, fn func(tx *Tx) error) (err error) {
+	defer observe("WithTransaction", time.Now(), &err)
+	return db.withTx(ctx, nil, fn)
+}
+
+// withTx runs fn inside a transaction that uses the cached prepared statements
+// for queries. The whole transaction is run again while the database is busy,
+// see Config.MaxRetries.
+func (db *DB) withTx(ctx context.Context, queries []string, fn func(tx *Tx) error) error {
+	return db.retry(ctx, func() error {
+		return db.runTx(ctx, queries, fn)
+	})
+}
+
+// runTx does a single attempt of withTx
+func (db *DB) runTx(ctx context.Context, queries []string, fn func(tx *Tx) error) error {
+	// The statements are fetched for every attempt, a reconnect replaces them
+	prepared, err := db.prepare(ctx, queries...)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return err
+	}
+	// Rollback() is a no-op after a successful Commit()
+	defer tx.Rollback()
+
+	err = fn(&Tx{db: db, tx: tx, ctx: ctx, prepared: prepared})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// errDryRun rolls back the transaction of destructiveTx
+var errDryRun = errors.New("dry run")
+
+// destructiveTx is like withTx for the operations that honor Config.DryRun
+// In dry run mode the transaction is rolled back even if fn succeeds.
+func (db *DB) destructiveTx(ctx context.Context, fn func(tx *Tx) error) error {
+	err := db.withTx(ctx, nil, func(tx *Tx) error {
+		err := fn(tx)
+		if err == nil && db.config.DryRun {
+			return errDryRun
+		}
+		return err
+	})
+	if errors.Is(err, errDryRun) {
+		return nil
+	}
+	return err
+}
+
+// prepare returns the cached prepared statements for queries
+// It has to be called before the transaction starts, since preparing
+// a statement needs a connection of its own.
+func (db *DB) prepare(ctx context.Context, queries ...string) (map[string]*sql.Stmt, error) {
+	prepared := make(map[string]*sql.Stmt, len(queries))
+	for _, query := range queries {
+		stmt, err := db.stmt(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		prepared[query] = stmt
+	}
+	return prepared, nil
+}
+
+// exec runs query within the transaction
+func (t *Tx) exec(query string, args ...any) (sql.Result, error) {
+	if stmt, ok := t.prepared[query]; ok {
+		return t.tx.StmtContext(t.ctx, stmt).ExecContext(t.ctx, args...)
+	}
+	return t.tx.ExecContext(t.ctx, t.db.sql(query), args...)
+}
+
+// queryRow runs query, which returns at most one row, within the transaction
+func (t *Tx) queryRow(query string, args ...any) *sql.Row {
+	if stmt, ok := t.prepared[query]; ok {
+		return t.tx.StmtContext(t.ctx, stmt).QueryRowContext(t.ctx, args...)
+	}
+	return t.tx.QueryRowContext(t.ctx, t.db.sql(query), args...)
+}
+
+// userID returns the ID of the user with the given normalized username,
+// -1 if there is no such user
+func (t *Tx) userID(username string) (int, error) {
+	var id int
+	err := t.queryRow(selectUserID, username).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return -1, nil
+	}
+	if err != nil {
+		return -1, fmt.Errorf("looking up user %s: %w", username, err)
+	}
+	return id, nil
+}
+
+// AddUser is like DB.AddUser but runs within the transaction
+// The password is hashed within it too, which holds the write lock for as long.
+func (t *Tx) AddUser(d Userdata) (int, error) {
+	hash, err := hashPassword(d.Password)
+	if err != nil {
+		return -1, err
+	}
+	return t.addUser(d, hash)
+}
+
+// addUser is AddUser with the password of d already hashed
+func (t *Tx) addUser(d Userdata, hash sql.NullString) (int, error) {
+	d.Username = t.db.normalizeUsername(d.Username)
+	err := t.db.validate(&d)
+	if err != nil {
+		return -1, err
+	}
+
+	if !t.db.config.SkipExistsCheck {
+		// A failing lookup aborts, instead of being taken for a new username
+		userID, err := t.userID(d.Username)
+		if err != nil {
+			return -1, err
+		}
+		if userID != -1 {
+			return -1, &UserExistsError{Username: d.Username}
+		}
+	}
+
+	res, err := t.exec(insertUsers, d.Username, hash)
+	if isUniqueViolation(err) {
+		// Another AddUser call inserted the same username after our check,
+		// or there was no check, see Config.SkipExistsCheck
+		return -1, &UserExistsError{Username: d.Username}
+	}
+	if err != nil {
+		return -1, fmt.Errorf("%w: %w", ErrInsert, err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return -1, fmt.Errorf("%w: %w", ErrInsert, err)
+	}
+	userID := int(id)
+
+	// `userID` field of Userdata table is the same value from Users table `ID` field
+	now := time.Now().Unix()
+	_, err = t.exec(insertUserdata, userID, d.Name, d.Surname, d.Description, d.Email, now, now)
+	if err != nil {
+		return -1, fmt.Errorf("%w: %w", ErrInsert, err)
+	}
+	return userID, nil
+}
+
+// UpdateUser is like DB.UpdateUser but runs within the transaction
+func (t *Tx) UpdateUser(d Userdata) error {
+	err := t.db.validate(&d)
+	if err != nil {
+		return err
+	}
+
+	// Let's check if the user exists first
+	d.Username = t.db.normalizeUsername(d.Username)
+	userID, err := t.userID(d.Username)
+	if err != nil {
+		return err
+	}
+	if userID == -1 {
+		return &UserNotFoundError{Username: d.Username}
+	}
+	if d.ID != 0 && d.ID != userID {
+		return fmt.Errorf("%w: %s has ID %d, not %d", ErrIDMismatch, d.Username, userID, d.ID)
+	}
+
+	d.ID = userID
+	res, err := t.exec(updateUserdata, d.Name, d.Surname, d.Description, d.Email, time.Now().Unix(), d.ID)
+	if err != nil {
+		return err
+	}
+
+	// SQLite counts the rows matched by WHERE, even if no value changed,
+	// so zero means that the user has no Userdata row
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return &UserNotFoundError{ID: d.ID}
+	}
+	return nil
+}
+
+// UpsertUser is like DB.UpsertUser but runs within the transaction
+func (t *Tx) UpsertUser(d Userdata) (int, error) {
+	hash, err := hashPassword(d.Password)
+	if err != nil {
+		return -1, err
+	}
+	userID, _, err := t.upsertUser(d, hash)
+	return userID, err
+}
+
+// upsertUser is UpsertUser with the password of d already hashed,
+// that also reports whether d was added
+func (t *Tx) upsertUser(d Userdata, hash sql.NullString) (int, bool, error) {
+	d.Username = t.db.normalizeUsername(d.Username)
+	userID, err := t.userID(d.Username)
+	if err != nil {
+		return -1, false, err
+	}
+	if userID == -1 {
+		userID, err = t.addUser(d, hash)
+		return userID, err == nil, err
+	}
+
+	err = t.db.validate(&d)
+	if err != nil {
+		return -1, false, err
+	}
+	now := time.Now().Unix()
+	res, err := t.exec(upsertUserdata, d.Name, d.Surname, d.Description, now, userID)
+	if err != nil {
+		return -1, false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return -1, false, err
+	}
+	if n == 0 {
+		// The user has no Userdata row, there is no Email to keep
+		_, err = t.exec(insertUserdata, userID, d.Name, d.Surname, d.Description, d.Email, now, now)
+		if err != nil {
+			return -1, false, err
+		}
+	}
+	return userID, false, nil
+}
+
+// DeleteUser is like DB.DeleteUser but runs within the transaction
+func (t *Tx) DeleteUser(id int) error {
+	deleted, err := t.db.deleteUserTx(t.ctx, t.tx, id)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return &UserNotFoundError{ID: id}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package sqlite06
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+// validateUsername checks that username is not empty or only whitespace
+func validateUsername(username string) error {
+	if strings.TrimSpace(username) == "" {
+		return fmt.Errorf("%w: %q is empty", ErrInvalidUsername, username)
+	}
+	return nil
+}
+
+// maxNameLength is the longest Name or Surname accepted by UpdateName, in characters
+const maxNameLength = 100
+
+// validateName checks that value, the Name or Surname given by field,
+// is not empty or only whitespace and at most maxNameLength long
+func validateName(field, value string) error {
+	if strings.TrimSpace(value) == "" {
+		return fmt.Errorf("%w: %s is empty", ErrInvalidName, field)
+	}
+	if length := utf8.RuneCountInString(value); length > maxNameLength {
+		return fmt.Errorf("%w: %s has %d characters, at most %d are allowed", ErrInvalidName, field, length, maxNameLength)
+	}
+	return nil
+}
+
+// validateEmail checks that email is a single bare address like user@example.com
+// An empty email is valid, since the field is optional
+func validateEmail(email string) error {
+	if email == "" {
+		return nil
+	}
+
+	// ParseAddress also accepts forms like "Name <user@example.com>",
+	// only the bare address is stored though
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return fmt.Errorf("%w: %q: %w", ErrInvalidEmail, email, err)
+	}
+	if addr.Address != email {
+		return fmt.Errorf("%w: %q is not a bare address", ErrInvalidEmail, email)
+	}
+	return nil
+}
+
+// normalizeDescription returns description without its invalid UTF-8,
+// which would make scanning the row fail later, and checks it against
+// Config.MaxDescriptionLength, truncating it if Config.TruncateDescription is set
+func (db *DB) normalizeDescription(description string) (string, error) {
+	description = strings.ToValidUTF8(description, "")
+
+	limit := db.config.MaxDescriptionLength
+	length := utf8.RuneCountInString(description)
+	if limit <= 0 || length <= limit {
+		return description, nil
+	}
+	if !db.config.TruncateDescription {
+		return "", fmt.Errorf("%w: %d characters, at most %d are allowed", ErrInvalidDescription, length, limit)
+	}
+	return string([]rune(description)[:limit]), nil
+}
+
+// validate checks the fields of d before they are written to the database
+// and normalizes its Description
+func (db *DB) validate(d *Userdata) error {
+	err := validateUsername(d.Username)
+	if err != nil {
+		return err
+	}
+	err = validateEmail(d.Email)
+	if err != nil {
+		return err
+	}
+	d.Description, err = db.normalizeDescription(d.Description)
+	return err
+}